@@ -1,21 +1,44 @@
 package conf
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
 // Conf : JSON root
 type Conf struct {
 	// Instances 為陣列，包含了多個 ConfInstance
 	Instances []Instance
-	LogLevel  string  `json:"LogLevel"`
-	Logger    *Logger `json:"Logger"`
+	// Include 為 glob 陣列 , 如 conf.d/*.json , 相對路徑以主設定檔所在目錄為準
+	// 每個被 include 的檔案可以提供一個或多個 Instance
+	Include  []string `json:"Include"`
+	LogLevel string   `json:"LogLevel"`
+	// LogFormat log 的格式 , text (預設) , logfmt 或 json , 後兩者會輸出 instance , pid 等欄位供 log 收集工具索引
+	LogFormat string `json:"LogFormat"`
+	// TimeFormat log 的時間格式 , 可以是 Go 的 time layout 或 RFC3339 , RFC3339Nano , RFC1123 , Unix , 預設 2006-01-02 15:04:05 -0700
+	TimeFormat string `json:"TimeFormat"`
+	// Logger log 的輸出 , 可以是單一物件或陣列 , 沒有設定時輸出至 console (stderr)
+	Logger Loggers `json:"Logger"`
+	// Hooks 發生 php-cgi 異常結束 , 沒有 idle 的 php-cgi 或服務停止等事件時 , 執行命令或呼叫 webhook
+	Hooks []Hook `json:"Hooks"`
+
+	secretFields map[string]string // 由 ${...} 展開的欄位位置 , 對應遮蔽後的值 , 輸出設定時使用
 }
 
 // Instance : JSON Instances
 type Instance struct {
+	// Name 為 Instance 的名稱 , 可省略 , 用來比對 systemd LISTEN_FDNAMES 傳入的 listener
+	Name string `json:"Name"`
+	// Bind 可以是 IP:Port , unix:/path/to.sock 或 windows named pipe (pipe:name)
+	// 有 Name 的 Instance 可以不設定 Bind , 只接受其他 Instance 的 Routes 轉送
 	Bind     string   `json:"Bind"`
 	ExecPath string   `json:"ExecPath"`
 	Args     []string `json:"Args"`
@@ -24,36 +47,544 @@ type Instance struct {
 	MaxRequestsPerProcess int `json:"MaxRequestsPerProcess,500"`
 	// MaxProcesses 定義 Instance 啟動 php-cgi 的最大數量，default 4
 	MaxProcesses int `json:"MaxProcesses,4"`
+	// MaxConnections Bind 同時處理的連線上限 , 預設為 MaxProcesses 加上 Routes 目標的 MaxProcesses
+	// DeferAcquire 或 ReadHeaderTimeout 時預設為 4 倍 , 讀完 head 的連線會等待 idle 的 php-cgi
+	// HTTPListen 只有設定時才限制 , keep-alive 的連線會一直佔用名額
+	MaxConnections int `json:"MaxConnections"`
+	// MaxConnectionsPerClient 每個來源 IP 同時連線到 Bind 及 HTTPListen 的上限 , 超過的連線直接關閉 , 0 代表不限制 , 對 unix socket 及 named pipe 無效
+	MaxConnectionsPerClient int `json:"MaxConnectionsPerClient"`
+	// RateLimit 每秒最多處理幾個要求 (token bucket) , 包含 Bind , HTTPListen 及 Routes 轉送進來的 , 0 代表不限制
+	// Bind 以連線計算 , keep-alive 的 FastCGI 連線只算一次 ; HTTPListen 及 Routes 每個要求各算一次
+	RateLimit float64 `json:"RateLimit"`
+	// RateBurst 短時間內最多可以累積的要求數量 , 預設為 RateLimit 無條件進位
+	RateBurst int `json:"RateBurst"`
+	// RateLimitMode 超過 RateLimit 時的處理方式 , reject (預設 , 直接拒絕) 或 queue (等待到可以處理或 client 關閉連線)
+	RateLimitMode string `json:"RateLimitMode"`
+	// Strategy 選擇閒置 php-cgi 的方式 , fifo (預設) , lifo , least-requests 或 random
+	Strategy string `json:"Strategy"`
+	// MaxMemoryPerProcess php-cgi 的 RSS 超過此值 (MB) 時 , 下次閒置時重新啟動 , 0 代表不限制
+	MaxMemoryPerProcess int `json:"MaxMemoryPerProcess"`
+	// MaxProcessLifetime php-cgi 執行超過此秒數後 , 下次閒置時重新啟動 , 0 代表不限制
+	MaxProcessLifetime int `json:"MaxProcessLifetime"`
+	// PHPValues 同 php-fpm 的 php_value , 啟動時以 -d 帶入 (php-cgi 不處理 PHP_VALUE)
+	PHPValues map[string]string `json:"PHPValues"`
+	// PHPAdminValues 類似 php-fpm 的 php_admin_value , 只在啟動時以 -d 帶入 , 與 PHPValues 相同 key 時優先
+	// php-cgi 不處理 PHP_ADMIN_VALUE , 所以程式仍可以 ini_set 修改 PHP_INI_ALL 的設定
+	PHPAdminValues map[string]string `json:"PHPAdminValues"`
+	// ListenOwner , ListenGroup 及 ListenMode (8 進位字串 , 如 "0660") 只對 unix socket 有效
+	ListenOwner string `json:"ListenOwner"`
+	ListenGroup string `json:"ListenGroup"`
+	ListenMode  string `json:"ListenMode"`
+	// AllowedClients 允許連線到 Bind 及 HTTPListen 的 IP 或 CIDR , 同 php-fpm 的 listen.allowed_clients , 空的代表不限制
+	AllowedClients []string `json:"AllowedClients"`
+	// User , Group 為 php-cgi 執行的身分 (名稱或數字) , 只支援 Linux / Unix , wphpfpm 必須以 root 執行
+	// Groups 為附加群組 , 沒有設定時使用 User 本身所屬的群組
+	User   string   `json:"User"`
+	Group  string   `json:"Group"`
+	Groups []string `json:"Groups"`
+	// Limits php-cgi 的資源限制 , 只支援 Linux , 不需要時可以拿掉整個 Limits 區段
+	Limits *Limits `json:"Limits"`
+	// ConnectRetries 無法連線 php-cgi 時 , 換另一個 php-cgi 重試的次數 , 預設 2 , 負數代表不重試
+	ConnectRetries int `json:"ConnectRetries"`
+	// StartupTimeout 等待新啟動的 php-cgi 可以連線的秒數 , 預設 10 秒 , 逾時的 php-cgi 會被終止
+	StartupTimeout int `json:"StartupTimeout"`
+	// ReadHeaderTimeout web server 連線後 , 必須在此秒數內送完第一個要求的 BEGIN_REQUEST 及 PARAMS , 0 代表不限制
+	// 設定後同 DeferAcquire , 讀完之後才取得 php-cgi
+	ReadHeaderTimeout int `json:"ReadHeaderTimeout"`
+	// IdleTimeout 連線上雙向都沒有資料超過此秒數時中斷連線 , 0 代表不限制
+	IdleTimeout int `json:"IdleTimeout"`
+	// WriteTimeout 寫給 web server 的每次寫入 , 超過此秒數仍無法完成時中斷連線 , 0 代表不限制
+	WriteTimeout int `json:"WriteTimeout"`
+	// DeferAcquire 收到第一個要求的 BEGIN_REQUEST 及 PARAMS 之後才取得 php-cgi , 避免沒有送出資料的連線佔用 php-cgi
+	DeferAcquire bool `json:"DeferAcquire"`
+	// Warmup 每個新啟動的 php-cgi 放進 idle 之前 , 依序送出的要求 , 用來預熱 opcache 及 autoloader
+	Warmup []Warmup `json:"Warmup"`
+	// Routes 依 FastCGI params 將連線轉送到其他 Instance , 依序比對 , 都不符合時由自己處理
+	Routes []Route `json:"Routes"`
+	// TLS 設定後 , Bind 以 TLS 加密 , 不需要時可以拿掉整個 TLS 區段
+	TLS *TLS `json:"TLS"`
+	// HTTPListen 設定後 (如 127.0.0.1:8080) , 直接以 HTTP 提供服務 , 不需要前面再架 nginx 或 Caddy
+	// 設定 HTTPListen 的 Instance 可以不設定 Bind
+	HTTPListen string `json:"HTTPListen"`
+	// DocumentRoot HTTPListen 的網站根目錄 , 設定 HTTPListen 時必須設定
+	DocumentRoot string `json:"DocumentRoot"`
+	// IndexFiles 請求目錄時依序尋找的檔案 , 預設 index.php , index.html
+	IndexFiles []string `json:"IndexFiles"`
+	// FrontController 找不到檔案時改由此 script 處理 (相對於 DocumentRoot) , 如 index.php , 空的代表返回 404
+	FrontController string `json:"FrontController"`
+	// MaxRequestBody HTTPListen 要求 body 的上限 (MB) , 預設 8 (同 PHP 的 post_max_size) , 超過時返回 413
+	MaxRequestBody int `json:"MaxRequestBody"`
+	// ReadTimeout HTTPListen 讀取整個要求 (header 及 body) 的秒數上限 , 預設 60 秒 , body 讀完之後才會取得 php-cgi
+	ReadTimeout int `json:"ReadTimeout"`
 	// Note 只是註解，此欄位沒有任何作用
 	Note string `json:"-"`
+	// Source 記錄這個 Instance 來自哪個設定檔 , 由 LoadFile 填入
+	Source string `json:"-"`
+}
+
+// TLS : Instance 的 TLS 設定 , 憑證檔案更新後會自動重新載入
+type TLS struct {
+	CertFile string `json:"CertFile"`
+	KeyFile  string `json:"KeyFile"`
+	// ClientCAFile 設定後 , client 必須提供由此 CA 簽發的憑證 (mutual TLS)
+	ClientCAFile string `json:"ClientCAFile"`
+	// MinVersion 可以是 1.0 , 1.1 , 1.2 , 1.3 , 預設 1.2
+	MinVersion string `json:"MinVersion"`
+}
+
+// Warmup : 預熱用的 FastCGI 要求 , 以 GET 執行 Script
+type Warmup struct {
+	// Script 為 SCRIPT_FILENAME
+	Script string `json:"Script"`
+	// Params 額外的 FastCGI params , 如 REQUEST_URI , SERVER_NAME
+	Params map[string]string `json:"Params"`
+	// Timeout 單位是秒 , 預設 10 秒 , 逾時或 php-cgi 回應 5xx 都視為失敗
+	Timeout int `json:"Timeout"`
+}
+
+// Route : 轉送規則 , Param 的值等於 Equals 或以 Prefix 開頭時 , 交給名稱為 Instance 的 php-cgi 處理
+type Route struct {
+	// Param 為 FastCGI param 名稱 , 如 SERVER_NAME , DOCUMENT_ROOT , SCRIPT_FILENAME
+	Param    string `json:"Param"`
+	Equals   string `json:"Equals"`
+	Prefix   string `json:"Prefix"`
+	Instance string `json:"Instance"`
+}
+
+// Limits : 每個 php-cgi 的資源限制 , 沒有設定的項目沿用 wphpfpm 本身的設定
+type Limits struct {
+	// MaxAddressSpace 虛擬記憶體上限 , 單位是 MB (RLIMIT_AS)
+	MaxAddressSpace *uint64 `json:"MaxAddressSpace"`
+	// MaxCPUTime CPU 時間上限 , 單位是秒 (RLIMIT_CPU)
+	MaxCPUTime *uint64 `json:"MaxCPUTime"`
+	// MaxOpenFiles 最多能開啟的檔案數量 (RLIMIT_NOFILE)
+	MaxOpenFiles *uint64 `json:"MaxOpenFiles"`
+	// MaxCoreSize core dump 大小上限 , 單位是 MB , 0 代表不產生 core dump (RLIMIT_CORE)
+	MaxCoreSize *uint64 `json:"MaxCoreSize"`
+	// Nice 行程優先權 , -20 ~ 19 , 數字越大優先權越低
+	Nice int `json:"Nice"`
+	// CPUAffinity 限制 php-cgi 只能在這些 CPU 上執行 , 如 [0, 1]
+	CPUAffinity []int `json:"CPUAffinity"`
+}
+
+// Hook : 事件發生時執行的命令或呼叫的 webhook , Command 與 URL 擇一
+type Hook struct {
+	// Events 要通知的事件 , 如 process.crashed , 空的代表全部
+	Events []string `json:"Events"`
+	// Command 執行的命令及參數 , 事件以 JSON 由 stdin 傳入
+	Command []string `json:"Command"`
+	// URL 以 POST 送出事件 JSON 的 webhook
+	URL string `json:"URL"`
+	// Headers webhook 額外的 header , 如 Authorization
+	Headers map[string]string `json:"Headers"`
+	// Timeout 每次執行命令或呼叫 webhook 的秒數上限 , 預設 10 秒
+	Timeout int `json:"Timeout"`
+	// Debounce 同一個來源的同一種事件 , 此秒數內只通知一次 , 期間內的合併為一次通知 , 0 代表每次都通知
+	Debounce int `json:"Debounce"`
+	// Retries 失敗時重試的次數 , 預設 3 , 負數代表不重試
+	Retries int `json:"Retries"`
+	// QueueSize 等待送出及重試的事件上限 , 超過時丟棄最舊的 , 預設 100
+	QueueSize int `json:"QueueSize"`
+}
+
+// includeFile : Include 進來的 JSON 檔案格式
+type includeFile struct {
+	Instances []Instance
 }
 
-// Logger : the same lumberjack.Logger
+// UnmarshalJSON 不接受未知的欄位 , 避免 "Instance" 之類的打字錯誤或巢狀的 Include 被忽略而少了 Instance
+func (f *includeFile) UnmarshalJSON(data []byte) error {
+	type plain includeFile
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	return d.Decode((*plain)(f))
+}
+
+// Logger : 一個 log 輸出 , file 的欄位同 lumberjack.Logger
 // see https://github.com/natefinch/lumberjack
 type Logger struct {
+	// Type 輸出的種類 , stdout , stderr , file 或 syslog , 空的時候有 Filename 為 file , 否則為 stderr
+	Type       string `json:"Type"`
 	Filename   string `json:"Filename"`
 	MaxSize    int    `json:"MaxSize,10"`
 	MaxAge     int    `json:"MaxAge,7"`
 	MaxBackups int    `json:"MaxBackups,4"`
 	LocalTime  bool   `json:"LocalTime,true"`
 	Compress   bool   `json:"Compress,false"`
+	// Level 這個輸出的最低等級 , 空的代表 LogLevel
+	Level string `json:"Level"`
+	// Format 這個輸出的格式 , 空的代表 LogFormat
+	Format string `json:"Format"`
+	// Address syslog 的位址 , 如 unixgram:/dev/log , udp:127.0.0.1:514 或 tcp:127.0.0.1:601 , 空的代表本機的 /dev/log
+	Address string `json:"Address"`
+	// Facility syslog 的 facility , 如 daemon (預設) , user 或 local0 ~ local7
+	Facility string `json:"Facility"`
+	// Tag syslog 的 APP-NAME , 預設 wphpfpm
+	Tag string `json:"Tag"`
 }
 
-// LoadFile 讀取 JSON 設定檔，並返回 *Conf
-func LoadFile(filePath string) (conf *Conf, err error) {
+// Loggers : 多個 log 輸出 , JSON 可以是單一物件 (舊的格式) 或陣列
+type Loggers []Logger
+
+// UnmarshalJSON 接受單一物件或陣列
+func (loggers *Loggers) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) > 0 && b[0] == '{' {
+		var logger Logger
+		if err := json.Unmarshal(b, &logger); err != nil {
+			return err
+		}
+		*loggers = Loggers{logger}
+		return nil
+	}
+	var list []Logger
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*loggers = list
+	return nil
+}
 
-	jsonFile, err := os.Open(filePath)
+// SinkType 返回 Type , 沒有設定時依 Filename 決定 file 或 stderr
+func (logger *Logger) SinkType() string {
+	if logger.Type != "" {
+		return logger.Type
+	}
+	if logger.Filename != "" {
+		return "file"
+	}
+	return "stderr"
+}
+
+// SyslogAddress 將 Address 分為 network 及 address , 沒有 network 時為 udp , 空的時候為本機的 /dev/log
+func (logger *Logger) SyslogAddress() (network string, address string, err error) {
+	if logger.Address == "" {
+		return "unixgram", "/dev/log", nil
+	}
+	i := strings.Index(logger.Address, ":")
+	if i > 0 {
+		switch network = logger.Address[:i]; network {
+		case "unixgram", "udp", "tcp":
+			return network, logger.Address[i+1:], nil
+		}
+	}
+	_, port, err := net.SplitHostPort(logger.Address)
+	if err == nil {
+		_, err = strconv.ParseUint(port, 10, 16)
+	}
 	if err != nil {
-		return
+		return "", "", fmt.Errorf("invalid syslog Address %s", logger.Address)
+	}
+	return "udp", logger.Address, nil
+}
+
+// SyslogFacilities syslog facility 的名稱及代碼 (RFC 5424)
+var SyslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// validLogLevel 檢查 level 是否為 logrus 可以解析的等級
+func validLogLevel(level string) bool {
+	switch strings.ToLower(level) {
+	case "panic", "fatal", "error", "warn", "warning", "info", "debug", "trace":
+		return true
+	}
+	return false
+}
+
+// validLogFormat 檢查 LogFormat 或 Logger Format
+func validLogFormat(format string) bool {
+	switch format {
+	case "", "text", "logfmt", "json":
+		return true
 	}
-	defer jsonFile.Close()
+	return false
+}
+
+// LoadFile 讀取 JSON 設定檔，並返回 *Conf
+// Include 每次呼叫都會重新展開 , 所以重新載入時會讀到新放進來的檔案
+func LoadFile(filePath string) (conf *Conf, err error) {
 
 	conf = &Conf{LogLevel: "ERROR"}
-	byteValue, _ := ioutil.ReadAll(jsonFile)
-	err = json.Unmarshal(byteValue, &conf)
+	// masked 是 ${...} 以 RedactedText 展開的同一份設定 , 用來找出哪些欄位來自變數
+	masked := &Conf{LogLevel: "ERROR"}
+	if err = conf.readJSON(filePath, conf, masked); err != nil {
+		return nil, err
+	}
+	for i := range conf.Instances {
+		conf.Instances[i].Source = filePath
+	}
+
+	if err = conf.loadIncludes(filepath.Dir(filePath), masked); err != nil {
+		return nil, err
+	}
+	conf.findSecrets(conf, masked)
+
+	if err = conf.Validate(); err != nil {
+		return nil, err
+	}
 	return
 }
 
+// loadIncludes 展開 Include 並將 Instance 合併到 conf.Instances
+func (conf *Conf) loadIncludes(baseDir string, masked *Conf) error {
+	for _, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(baseDir, pattern)
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("Include %s : %s", pattern, err.Error())
+		}
+		// filepath.Glob 返回的結果已經排序 , 所以合併的順序是固定的
+		for _, file := range files {
+			inc, maskedInc := includeFile{}, includeFile{}
+			if err := conf.readJSON(file, &inc, &maskedInc); err != nil {
+				return err
+			}
+			for i := range inc.Instances {
+				inc.Instances[i].Source = file
+			}
+			conf.Instances = append(conf.Instances, inc.Instances...)
+			masked.Instances = append(masked.Instances, maskedInc.Instances...)
+		}
+	}
+	return nil
+}
+
+// Validate 檢查所有 Instance (包含 Include 進來的) , 錯誤訊息會包含來源檔案
+func (conf *Conf) Validate() error {
+	if !validLogFormat(conf.LogFormat) {
+		return fmt.Errorf("LogFormat %s is invalid", conf.LogFormat)
+	}
+	for i, logger := range conf.Logger {
+		switch logger.SinkType() {
+		case "stdout", "stderr":
+		case "file":
+			if logger.Filename == "" {
+				return fmt.Errorf("Logger #%d Filename is required by file", i)
+			}
+		case "syslog":
+			if _, _, err := logger.SyslogAddress(); err != nil {
+				return fmt.Errorf("Logger #%d %s", i, err.Error())
+			}
+			if _, ok := SyslogFacilities[logger.Facility]; !ok && logger.Facility != "" {
+				return fmt.Errorf("Logger #%d Facility %s is invalid", i, logger.Facility)
+			}
+		default:
+			return fmt.Errorf("Logger #%d Type %s is invalid", i, logger.Type)
+		}
+		if logger.Level != "" && !validLogLevel(logger.Level) {
+			return fmt.Errorf("Logger #%d Level %s is invalid", i, logger.Level)
+		}
+		if !validLogFormat(logger.Format) {
+			return fmt.Errorf("Logger #%d Format %s is invalid", i, logger.Format)
+		}
+	}
+	binds := make(map[string]string)
+	names := make(map[string]string)
+	for i, instance := range conf.Instances {
+		if instance.Bind == "" && instance.Name == "" && instance.HTTPListen == "" {
+			return fmt.Errorf("%s : instance #%d Bind is empty", instance.Source, i)
+		}
+		if instance.ExecPath == "" {
+			return fmt.Errorf("%s : instance #%d ExecPath is empty", instance.Source, i)
+		}
+		if instance.MaxMemoryPerProcess < 0 || instance.MaxProcessLifetime < 0 {
+			return fmt.Errorf("%s : instance #%d MaxMemoryPerProcess and MaxProcessLifetime can not be negative", instance.Source, i)
+		}
+		if instance.StartupTimeout < 0 {
+			return fmt.Errorf("%s : instance #%d StartupTimeout can not be negative", instance.Source, i)
+		}
+		if instance.MaxConnections < 0 {
+			return fmt.Errorf("%s : instance #%d MaxConnections can not be negative", instance.Source, i)
+		}
+		if instance.MaxConnectionsPerClient < 0 {
+			return fmt.Errorf("%s : instance #%d MaxConnectionsPerClient can not be negative", instance.Source, i)
+		}
+		if instance.RateLimit < 0 || instance.RateBurst < 0 {
+			return fmt.Errorf("%s : instance #%d RateLimit and RateBurst can not be negative", instance.Source, i)
+		}
+		switch instance.RateLimitMode {
+		case "", "reject", "queue":
+		default:
+			return fmt.Errorf("%s : instance #%d RateLimitMode %s is invalid", instance.Source, i, instance.RateLimitMode)
+		}
+		if instance.ReadHeaderTimeout < 0 || instance.IdleTimeout < 0 || instance.WriteTimeout < 0 {
+			return fmt.Errorf("%s : instance #%d ReadHeaderTimeout , IdleTimeout and WriteTimeout can not be negative", instance.Source, i)
+		}
+		for j, warmup := range instance.Warmup {
+			if warmup.Script == "" {
+				return fmt.Errorf("%s : instance #%d Warmup #%d Script is empty", instance.Source, i, j)
+			}
+			if warmup.Timeout < 0 {
+				return fmt.Errorf("%s : instance #%d Warmup #%d Timeout can not be negative", instance.Source, i, j)
+			}
+		}
+		switch instance.Strategy {
+		case "", "fifo", "lifo", "least-requests", "random":
+		default:
+			return fmt.Errorf("%s : instance #%d Strategy %s is invalid", instance.Source, i, instance.Strategy)
+		}
+		if _, err := instance.ListenFileMode(); err != nil {
+			return fmt.Errorf("%s : instance #%d ListenMode %s is invalid", instance.Source, i, instance.ListenMode)
+		}
+		for _, client := range instance.AllowedClients {
+			if !validClient(client) {
+				return fmt.Errorf("%s : instance #%d AllowedClients %s is not an IP or CIDR", instance.Source, i, client)
+			}
+		}
+		if instance.TLS != nil {
+			if instance.TLS.CertFile == "" || instance.TLS.KeyFile == "" {
+				return fmt.Errorf("%s : instance #%d TLS CertFile and KeyFile are required", instance.Source, i)
+			}
+			switch instance.TLS.MinVersion {
+			case "", "1.0", "1.1", "1.2", "1.3":
+			default:
+				return fmt.Errorf("%s : instance #%d TLS MinVersion %s is invalid", instance.Source, i, instance.TLS.MinVersion)
+			}
+		}
+		if instance.HTTPListen != "" {
+			if _, _, err := net.SplitHostPort(instance.HTTPListen); err != nil {
+				return fmt.Errorf("%s : instance #%d HTTPListen %s is invalid", instance.Source, i, instance.HTTPListen)
+			}
+			if instance.DocumentRoot == "" {
+				return fmt.Errorf("%s : instance #%d DocumentRoot is required by HTTPListen", instance.Source, i)
+			}
+			if instance.MaxRequestBody < 0 || instance.ReadTimeout < 0 {
+				return fmt.Errorf("%s : instance #%d MaxRequestBody and ReadTimeout can not be negative", instance.Source, i)
+			}
+		}
+		if instance.Limits != nil {
+			if instance.Limits.Nice < -20 || instance.Limits.Nice > 19 {
+				return fmt.Errorf("%s : instance #%d Limits Nice must be between -20 and 19", instance.Source, i)
+			}
+			for _, cpu := range instance.Limits.CPUAffinity {
+				if cpu < 0 {
+					return fmt.Errorf("%s : instance #%d Limits CPUAffinity %d is invalid", instance.Source, i, cpu)
+				}
+			}
+		}
+		if instance.Bind != "" {
+			if source, ok := binds[instance.Bind]; ok {
+				return fmt.Errorf("%s : instance #%d Bind %s is already used in %s", instance.Source, i, instance.Bind, source)
+			}
+			binds[instance.Bind] = instance.Source
+		}
+		if instance.HTTPListen != "" {
+			if source, ok := binds[instance.HTTPListen]; ok {
+				return fmt.Errorf("%s : instance #%d HTTPListen %s is already used in %s", instance.Source, i, instance.HTTPListen, source)
+			}
+			binds[instance.HTTPListen] = instance.Source
+		}
+		if instance.Name != "" {
+			if source, ok := names[instance.Name]; ok {
+				return fmt.Errorf("%s : instance #%d Name %s is already used in %s", instance.Source, i, instance.Name, source)
+			}
+			names[instance.Name] = instance.Source
+		}
+	}
+	// Routes 可以指向後面才定義的 Instance , 所以最後才檢查
+	for i, instance := range conf.Instances {
+		for j, route := range instance.Routes {
+			if route.Param == "" {
+				return fmt.Errorf("%s : instance #%d Routes #%d Param is empty", instance.Source, i, j)
+			}
+			if (route.Equals == "") == (route.Prefix == "") {
+				return fmt.Errorf("%s : instance #%d Routes #%d requires either Equals or Prefix", instance.Source, i, j)
+			}
+			if conf.InstanceIndex(route.Instance) < 0 {
+				return fmt.Errorf("%s : instance #%d Routes #%d Instance %s is not found", instance.Source, i, j, route.Instance)
+			}
+		}
+	}
+	for i, hook := range conf.Hooks {
+		if (len(hook.Command) == 0) == (hook.URL == "") {
+			return fmt.Errorf("Hooks #%d requires either Command or URL", i)
+		}
+		if hook.URL != "" {
+			if u, err := url.Parse(hook.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("Hooks #%d URL is not a http or https URL", i)
+			}
+		}
+		if hook.Timeout < 0 || hook.Debounce < 0 || hook.QueueSize < 0 {
+			return fmt.Errorf("Hooks #%d Timeout , Debounce and QueueSize can not be negative", i)
+		}
+	}
+	return nil
+}
+
+// InstanceIndex 返回名稱為 name 的 Instance 位置 , 找不到時返回 -1
+func (conf *Conf) InstanceIndex(name string) int {
+	if name == "" {
+		return -1
+	}
+	for i := range conf.Instances {
+		if conf.Instances[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// ListenFileMode 將 ListenMode 轉為 os.FileMode , 沒有設定時返回 0
+func (instance *Instance) ListenFileMode() (os.FileMode, error) {
+	if instance.ListenMode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(instance.ListenMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid ListenMode %s", instance.ListenMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validClient 檢查 AllowedClients 的值是否為 IP 或 CIDR
+func validClient(client string) bool {
+	client = strings.TrimSpace(client)
+	if strings.Contains(client, "/") {
+		_, _, err := net.ParseCIDR(client)
+		return err == nil
+	}
+	return net.ParseIP(client) != nil
+}
+
+// readJSON 讀取 JSON 檔案 , 展開所有字串值中的變數後存至 v , 錯誤訊息會包含檔名
+// masked 為 ${...} 以 RedactedText 展開的結果 , 與 v 的型別相同
+func (conf *Conf) readJSON(filePath string, v interface{}, masked interface{}) error {
+	byteValue, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	baseDir := filepath.Dir(filePath)
+	if err = unmarshalExpanded(byteValue, v, &interpolator{baseDir: baseDir}); err != nil {
+		return fmt.Errorf("%s : %s", filePath, err.Error())
+	}
+	if err = unmarshalExpanded(byteValue, masked, &interpolator{baseDir: baseDir, redact: true}); err != nil {
+		return fmt.Errorf("%s : %s", filePath, err.Error())
+	}
+	return nil
+}
+
+// unmarshalExpanded 以 ip 展開 JSON 中所有的字串值後存至 v
+func unmarshalExpanded(data []byte, v interface{}, ip *interpolator) error {
+	var raw interface{}
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	if raw, err = ip.expandValue(raw); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(raw); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
 // FileExist config file is exist 檢查檔案是否存在
 func FileExist(filePath string) bool {
 	if _, err := os.Stat(filePath); err != nil {
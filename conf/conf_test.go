@@ -0,0 +1,341 @@
+package conf
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadFileInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configFile := filepath.Join(dir, "config.json")
+	writeFile(t, configFile, `{
+		"Include": ["conf.d/*.json"],
+		"Instances": [{"Bind": "127.0.0.1:8000", "ExecPath": "php-cgi"}]
+	}`)
+	writeFile(t, filepath.Join(dir, "conf.d", "a.json"), `{
+		"Instances": [{"Bind": "127.0.0.1:8001", "ExecPath": "php-cgi"}, {"Bind": "127.0.0.1:8002", "ExecPath": "php-cgi"}]
+	}`)
+
+	c, err := LoadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Instances) != 3 {
+		t.Fatalf("expected 3 instances , got %d", len(c.Instances))
+	}
+	if c.Instances[2].Source != filepath.Join(dir, "conf.d", "a.json") {
+		t.Errorf("unexpected source %s", c.Instances[2].Source)
+	}
+
+	// 新放進來的檔案 , 重新載入時要讀得到
+	writeFile(t, filepath.Join(dir, "conf.d", "b.json"), `{
+		"Instances": [{"Bind": "127.0.0.1:8001", "ExecPath": "php-cgi"}]
+	}`)
+	_, err = LoadFile(configFile)
+	if err == nil {
+		t.Fatal("expected duplicate Bind error")
+	}
+	if !strings.Contains(err.Error(), "b.json") || !strings.Contains(err.Error(), "a.json") {
+		t.Errorf("error should name both files : %s", err.Error())
+	}
+
+	writeFile(t, filepath.Join(dir, "conf.d", "b.json"), `{"Instances": [`)
+	_, err = LoadFile(configFile)
+	if err == nil || !strings.Contains(err.Error(), "b.json") {
+		t.Errorf("parse error should name the file : %v", err)
+	}
+
+	// 打錯的欄位及巢狀的 Include 不能被忽略
+	for _, content := range []string{
+		`{"Instance": [{"Bind": "127.0.0.1:8003", "ExecPath": "php-cgi"}]}`,
+		`{"Include": ["other/*.json"]}`,
+		`{"Instances": [{"Bind": "127.0.0.1:8003", "ExecPaht": "php-cgi"}]}`,
+	} {
+		writeFile(t, filepath.Join(dir, "conf.d", "b.json"), content)
+		_, err = LoadFile(configFile)
+		if err == nil || !strings.Contains(err.Error(), "b.json") || !strings.Contains(err.Error(), "unknown field") {
+			t.Errorf("unknown field should be an error : %s , got %v", content, err)
+		}
+	}
+}
+
+func TestLoadFileInterpolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("WPHPFPM_TEST_PHP", "/opt/php8")
+	defer os.Unsetenv("WPHPFPM_TEST_PHP")
+	writeFile(t, filepath.Join(dir, "db_pass"), "s3cr\"et\n")
+
+	configFile := filepath.Join(dir, "config.json")
+	writeFile(t, configFile, `{
+		"Instances": [{
+			"Bind": "${WPHPFPM_TEST_BIND:-127.0.0.1:9000}",
+			"ExecPath": "${WPHPFPM_TEST_PHP}/bin/php-cgi",
+			"Env": ["DB_PASS=${file:db_pass}", "PRICE=$$5"]
+		}]
+	}`)
+
+	c, err := LoadFile(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instance := c.Instances[0]
+	if instance.Bind != "127.0.0.1:9000" {
+		t.Errorf("unexpected Bind %s", instance.Bind)
+	}
+	if instance.ExecPath != "/opt/php8/bin/php-cgi" {
+		t.Errorf("unexpected ExecPath %s", instance.ExecPath)
+	}
+	if instance.Env[0] != "DB_PASS=s3cr\"et" || instance.Env[1] != "PRICE=$5" {
+		t.Errorf("unexpected Env %v", instance.Env)
+	}
+
+	dump := c.String()
+	if strings.Contains(dump, "s3cr") || !strings.Contains(dump, "DB_PASS="+RedactedText) {
+		t.Errorf("secret is not redacted : %s", dump)
+	}
+	// 環境變數展開的值也會被遮蔽
+	if strings.Contains(dump, "/opt/php8") || !strings.Contains(dump, `"ExecPath": "`+RedactedText+`/bin/php-cgi"`) {
+		t.Errorf("environment variable is not redacted : %s", dump)
+	}
+
+	writeFile(t, configFile, `{"Instances": [{"Bind": "${WPHPFPM_TEST_UNSET}", "ExecPath": "php-cgi"}]}`)
+	if _, err = LoadFile(configFile); err == nil || !strings.Contains(err.Error(), "WPHPFPM_TEST_UNSET") {
+		t.Errorf("expected unset variable error : %v", err)
+	}
+}
+
+func TestRedactFields(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 很短的 secret 也只遮蔽來自 ${...} 的欄位 , Env 及 Headers 則一律遮蔽
+	os.Setenv("WPHPFPM_TEST_SECRET", "1")
+	defer os.Unsetenv("WPHPFPM_TEST_SECRET")
+	writeFile(t, filepath.Join(dir, "token"), "1\n")
+	writeFile(t, filepath.Join(dir, "config.json"), `{
+		"Include": ["conf.d/*.json"],
+		"Instances": [{"Bind": "127.0.0.1:9001", "ExecPath": "php-cgi", "MaxProcesses": 1,
+			"Args": ["-dA=1", "-dB=${WPHPFPM_TEST_SECRET}", "-dDOLLAR=$${file:token}"], "Env": ["A=1"]}],
+		"Hooks": [{"URL": "http://127.0.0.1/hook", "Headers": {"Authorization": "Bearer 1", "X-Token": "${file:token}"}}]
+	}`)
+	writeFile(t, filepath.Join(dir, "conf.d", "site.json"), `{"Instances": [{"Bind": "127.0.0.1:9002", "ExecPath": "php-cgi", "PHPValues": {"session.save_path": "${file:../token}"}}]}`)
+
+	c, err := LoadFile(filepath.Join(dir, "config.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := c.String()
+	for _, want := range []string{
+		`"Bind": "127.0.0.1:9001"`,
+		`"MaxProcesses": 1`,
+		`"-dA=1"`,
+		`"-dB=` + RedactedText + `"`,
+		`"-dDOLLAR=${file:token}"`,
+		`"A=` + RedactedText + `"`,
+		`"Authorization": "` + RedactedText + `"`,
+		`"X-Token": "` + RedactedText + `"`,
+		`"session.save_path": "` + RedactedText + `"`,
+	} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("String() does not contain %s : %s", want, dump)
+		}
+	}
+	// String() 不能修改設定本身
+	if c.Hooks[0].Headers["Authorization"] != "Bearer 1" || c.Instances[0].Env[0] != "A=1" || c.Instances[1].PHPValues["session.save_path"] != "1" {
+		t.Errorf("config is modified : %v %v %v", c.Hooks[0].Headers, c.Instances[0].Env, c.Instances[1].PHPValues)
+	}
+}
+
+func TestValidateRoutes(t *testing.T) {
+	c := &Conf{Instances: []Instance{
+		{Bind: "127.0.0.1:9000", ExecPath: "php-cgi", Routes: []Route{{Param: "SERVER_NAME", Equals: "php8.example.com", Instance: "php8"}}},
+		{Name: "php8", ExecPath: "php-cgi"},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("pool-only instance with a Name should be valid : %s", err.Error())
+	}
+
+	c.Instances[0].Routes[0].Instance = "php9"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "php9") {
+		t.Errorf("expected unknown instance error : %v", err)
+	}
+
+	c.Instances[0].Routes[0] = Route{Param: "SERVER_NAME", Equals: "a", Prefix: "b", Instance: "php8"}
+	if err := c.Validate(); err == nil {
+		t.Error("expected error when both Equals and Prefix are set")
+	}
+
+	c.Instances[0].Routes = nil
+	c.Instances[1].Name = ""
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for instance without Bind and Name")
+	}
+}
+
+func TestValidateHTTPListen(t *testing.T) {
+	c := &Conf{Instances: []Instance{
+		{Bind: "127.0.0.1:9000", ExecPath: "php-cgi"},
+		{HTTPListen: "127.0.0.1:8080", DocumentRoot: "/var/www", ExecPath: "php-cgi"},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatalf("HTTPListen without Bind should be valid : %s", err.Error())
+	}
+
+	c.Instances[1].DocumentRoot = ""
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "DocumentRoot") {
+		t.Errorf("expected DocumentRoot error : %v", err)
+	}
+
+	c.Instances[1].DocumentRoot = "/var/www"
+	c.Instances[1].HTTPListen = "127.0.0.1:9000"
+	if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("expected duplicate address error : %v", err)
+	}
+
+	c.Instances[1].HTTPListen = "8080"
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for HTTPListen without port")
+	}
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	c := &Conf{Instances: []Instance{
+		{Bind: "127.0.0.1:9000", ExecPath: "php-cgi", ReadHeaderTimeout: 5, IdleTimeout: 60, WriteTimeout: 30, DeferAcquire: true, MaxConnections: 32},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Instances[0].IdleTimeout = -1
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for negative IdleTimeout")
+	}
+	c.Instances[0].IdleTimeout = 0
+	c.Instances[0].MaxConnections = -1
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for negative MaxConnections")
+	}
+}
+
+func TestValidateRateLimit(t *testing.T) {
+	c := &Conf{Instances: []Instance{
+		{Bind: "127.0.0.1:9000", ExecPath: "php-cgi", MaxConnectionsPerClient: 8, RateLimit: 50, RateBurst: 100, RateLimitMode: "queue"},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Instances[0].RateLimitMode = "drop"
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for invalid RateLimitMode")
+	}
+	c.Instances[0].RateLimitMode = ""
+	c.Instances[0].RateLimit = -1
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for negative RateLimit")
+	}
+	c.Instances[0].RateLimit = 0
+	c.Instances[0].MaxConnectionsPerClient = -1
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for negative MaxConnectionsPerClient")
+	}
+}
+
+func TestValidateHooks(t *testing.T) {
+	c := &Conf{Hooks: []Hook{
+		{Command: []string{"/usr/local/bin/alert"}, Events: []string{"process.crashed"}},
+		{URL: "https://hooks.example.com/wphpfpm", Debounce: 60},
+	}}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.Hooks[0].URL = "https://hooks.example.com/"
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for both Command and URL")
+	}
+	c.Hooks[0] = Hook{URL: "ftp://hooks.example.com/"}
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for non http URL")
+	}
+	c.Hooks[0] = Hook{URL: "http://hooks.example.com/", QueueSize: -1}
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for negative QueueSize")
+	}
+}
+
+func TestValidateLogFormat(t *testing.T) {
+	c := &Conf{LogFormat: "json", TimeFormat: "RFC3339"}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	c.LogFormat = "xml"
+	if err := c.Validate(); err == nil {
+		t.Error("expected error for invalid LogFormat")
+	}
+}
+
+func TestLoggers(t *testing.T) {
+	var c Conf
+	if err := json.Unmarshal([]byte(`{"Logger": {"Filename": "wphpfpm.log", "MaxSize": 10}}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Logger) != 1 || c.Logger[0].SinkType() != "file" || c.Logger[0].MaxSize != 10 {
+		t.Fatalf("single Logger object = %+v", c.Logger)
+	}
+	c = Conf{}
+	if err := json.Unmarshal([]byte(`{"Logger": [
+		{"Type": "stdout", "Level": "INFO"},
+		{"Filename": "debug.log", "Level": "DEBUG", "Format": "json"},
+		{"Type": "syslog", "Address": "udp:127.0.0.1:514", "Level": "ERROR", "Facility": "local0"}
+	]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Logger) != 3 {
+		t.Fatalf("Logger array = %+v", c.Logger)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	network, address, err := c.Logger[2].SyslogAddress()
+	if err != nil || network != "udp" || address != "127.0.0.1:514" {
+		t.Errorf("SyslogAddress() = %s %s %v", network, address, err)
+	}
+
+	for _, logger := range []Logger{
+		{Type: "kafka"},
+		{Type: "file"},
+		{Type: "syslog", Address: "sctp:127.0.0.1"},
+		{Type: "syslog", Facility: "local9"},
+		{Type: "stderr", Level: "verbose"},
+		{Type: "stderr", Format: "xml"},
+	} {
+		c.Logger = Loggers{logger}
+		if err := c.Validate(); err == nil {
+			t.Errorf("expected error for %+v", logger)
+		}
+	}
+}
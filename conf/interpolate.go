@@ -0,0 +1,119 @@
+package conf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RedactedText 取代 secret 後顯示的文字
+const RedactedText = "******"
+
+// interpolator 負責展開設定值中的 ${VAR} , ${VAR:-default} 以及 ${file:/path}
+type interpolator struct {
+	baseDir string // file: 的相對路徑以此目錄為準
+	redact  bool   // 所有 ${...} 都不讀取 , 以 RedactedText 取代 , 用來找出來自變數的欄位
+}
+
+// expandValue 遞迴展開 json.Unmarshal 到 interface{} 的結果
+func (ip *interpolator) expandValue(v interface{}) (interface{}, error) {
+	switch value := v.(type) {
+	case string:
+		return ip.expand(value)
+	case []interface{}:
+		for i := range value {
+			expanded, err := ip.expandValue(value[i])
+			if err != nil {
+				return nil, err
+			}
+			value[i] = expanded
+		}
+	case map[string]interface{}:
+		for k := range value {
+			expanded, err := ip.expandValue(value[k])
+			if err != nil {
+				return nil, fmt.Errorf("%s : %s", k, err.Error())
+			}
+			value[k] = expanded
+		}
+	}
+	return v, nil
+}
+
+// expand 展開單一字串 , $$ 代表 $ 本身
+func (ip *interpolator) expand(s string) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		if s[i+1] == '$' {
+			b.WriteByte('$')
+			i++
+			continue
+		}
+		if s[i+1] != '{' {
+			b.WriteByte(s[i])
+			continue
+		}
+		end := strings.IndexByte(s[i+2:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated ${ in %q", s)
+		}
+		value, err := ip.resolve(s[i+2 : i+2+end])
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+		i += 2 + end
+	}
+	return b.String(), nil
+}
+
+// resolve 解析 ${...} 大括號內的內容
+func (ip *interpolator) resolve(ref string) (string, error) {
+	if ip.redact {
+		// 環境變數也可能是 secret (如 DB_PASS=${DB_PASS}) , 一律遮蔽
+		return RedactedText, nil
+	}
+	if strings.HasPrefix(ref, "file:") {
+		path := ref[len("file:"):]
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(ip.baseDir, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		// secret 檔案通常以換行結尾 , 去掉它
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+
+	name := ref
+	defaultValue := ""
+	hasDefault := false
+	if idx := strings.Index(ref, ":-"); idx >= 0 {
+		name = ref[:idx]
+		defaultValue = ref[idx+2:]
+		hasDefault = true
+	}
+	if name == "" {
+		return "", fmt.Errorf("empty variable name in ${%s}", ref)
+	}
+
+	value, ok := os.LookupEnv(name)
+	if hasDefault && value == "" {
+		return defaultValue, nil
+	}
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,116 @@
+package conf
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// walkStrings 走訪 v 中所有的字串 , path 為欄位的位置 (如 Instances[0].Env[1] , Hooks[0].Headers[Authorization])
+// 略過未匯出及 json:"-" 的欄位 , set 修改該字串 , v 不可修改時為 nil
+func walkStrings(v reflect.Value, path string, fn func(path string, s string, set func(string))) {
+	switch v.Kind() {
+	case reflect.String:
+		var set func(string)
+		if v.CanSet() {
+			set = v.SetString
+		}
+		fn(path, v.String(), set)
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			walkStrings(v.Elem(), path, fn)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" || field.Tag.Get("json") == "-" {
+				continue
+			}
+			walkStrings(v.Field(i), joinPath(path, field.Name), fn)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			walkStrings(v.Index(i), path+"["+strconv.Itoa(i)+"]", fn)
+		}
+	case reflect.Map:
+		// 設定檔中的 map 都是 map[string]string , map 的值無法直接修改 , 以 SetMapIndex 取代
+		if v.Type().Key().Kind() != reflect.String || v.Type().Elem().Kind() != reflect.String {
+			return
+		}
+		for _, key := range v.MapKeys() {
+			key := key
+			fn(path+"["+key.String()+"]", v.MapIndex(key).String(), func(s string) {
+				v.SetMapIndex(key, reflect.ValueOf(s).Convert(v.Type().Elem()))
+			})
+		}
+	}
+}
+
+// joinPath 組合欄位的位置
+func joinPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// findSecrets 比對同一份設定以實際值 (v) 及遮蔽 ${...} 後 (masked) 展開的結果 , 記錄不同的欄位
+func (conf *Conf) findSecrets(v interface{}, masked interface{}) {
+	maskedValues := make(map[string]string)
+	walkStrings(reflect.ValueOf(masked), "", func(path string, s string, set func(string)) {
+		maskedValues[path] = s
+	})
+	walkStrings(reflect.ValueOf(v), "", func(path string, s string, set func(string)) {
+		if m, ok := maskedValues[path]; ok && m != s {
+			if conf.secretFields == nil {
+				conf.secretFields = make(map[string]string)
+			}
+			conf.secretFields[path] = m
+		}
+	})
+}
+
+// redactEnv 遮蔽 KEY=value 的 value , 保留 KEY 方便除錯
+func redactEnv(env string) string {
+	if i := strings.IndexByte(env, '='); i >= 0 {
+		return env[:i+1] + RedactedText
+	}
+	return RedactedText
+}
+
+// String 返回遮蔽 secret 後的 JSON , 可直接用於 log
+// 由 ${...} 展開的部分 , Instance 的 Env 及 Hook 的 Headers 都會被遮蔽 , 其他文字保持原樣
+func (conf *Conf) String() string {
+	b, err := json.Marshal(conf)
+	if err != nil {
+		return err.Error()
+	}
+	// 在複本上遮蔽 , 不能修改 conf 本身
+	var c Conf
+	if err = json.Unmarshal(b, &c); err != nil {
+		return err.Error()
+	}
+	walkStrings(reflect.ValueOf(&c), "", func(path string, s string, set func(string)) {
+		if m, ok := conf.secretFields[path]; ok && set != nil {
+			set(m)
+		}
+	})
+	// Env 及 Headers 常直接寫入密碼或 token , 沒有使用變數也一律遮蔽
+	for i := range c.Instances {
+		for j, env := range c.Instances[i].Env {
+			c.Instances[i].Env[j] = redactEnv(env)
+		}
+	}
+	for i := range c.Hooks {
+		for key := range c.Hooks[i].Headers {
+			c.Hooks[i].Headers[key] = RedactedText
+		}
+	}
+	b, err = json.MarshalIndent(&c, "", "    ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
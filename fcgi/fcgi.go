@@ -0,0 +1,169 @@
+// Package fcgi 實作 FastCGI record 的讀寫 , 以及 PARAMS 的編碼與解碼
+// 規格參考 https://fast-cgi.github.io/spec
+package fcgi
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Record types
+const (
+	TypeBeginRequest    uint8 = 1
+	TypeAbortRequest    uint8 = 2
+	TypeEndRequest      uint8 = 3
+	TypeParams          uint8 = 4
+	TypeStdin           uint8 = 5
+	TypeStdout          uint8 = 6
+	TypeStderr          uint8 = 7
+	TypeData            uint8 = 8
+	TypeGetValues       uint8 = 9
+	TypeGetValuesResult uint8 = 10
+	TypeUnknownType     uint8 = 11
+)
+
+const (
+	// Version1 FastCGI 協定版本
+	Version1 uint8 = 1
+	// HeaderLength record header 的長度
+	HeaderLength = 8
+	// MaxContentLength 單一 record 最多能帶的資料長度
+	MaxContentLength = 65535
+)
+
+// ErrInvalidParams PARAMS 內容無法解析
+var ErrInvalidParams = errors.New("fcgi: invalid params")
+
+// Header : record header
+type Header struct {
+	Version       uint8
+	Type          uint8
+	RequestID     uint16
+	ContentLength uint16
+	PaddingLength uint8
+	Reserved      uint8
+}
+
+// Record : 一個完整的 FastCGI record , 不含 padding
+type Record struct {
+	Header
+	Content []byte
+}
+
+// ReadRecord 從 r 讀取一個 record , padding 會被丟棄
+// rec.Content 會重複使用原本的空間
+func ReadRecord(r io.Reader, rec *Record) error {
+	var h [HeaderLength]byte
+	if _, err := io.ReadFull(r, h[:]); err != nil {
+		return err
+	}
+	rec.Version = h[0]
+	rec.Type = h[1]
+	rec.RequestID = binary.BigEndian.Uint16(h[2:4])
+	rec.ContentLength = binary.BigEndian.Uint16(h[4:6])
+	rec.PaddingLength = h[6]
+	rec.Reserved = h[7]
+
+	n := int(rec.ContentLength) + int(rec.PaddingLength)
+	if cap(rec.Content) < n {
+		rec.Content = make([]byte, n)
+	}
+	rec.Content = rec.Content[:n]
+	if _, err := io.ReadFull(r, rec.Content); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	rec.Content = rec.Content[:rec.ContentLength]
+	return nil
+}
+
+// WriteRecord 寫出一個 record , content 不可超過 MaxContentLength
+func WriteRecord(w io.Writer, recType uint8, requestID uint16, content []byte) error {
+	if len(content) > MaxContentLength {
+		return errors.New("fcgi: content too long")
+	}
+	padding := (8 - len(content)%8) % 8
+	b := make([]byte, HeaderLength+len(content)+padding)
+	b[0] = Version1
+	b[1] = recType
+	binary.BigEndian.PutUint16(b[2:4], requestID)
+	binary.BigEndian.PutUint16(b[4:6], uint16(len(content)))
+	b[6] = uint8(padding)
+	copy(b[HeaderLength:], content)
+	_, err := w.Write(b)
+	return err
+}
+
+// WriteStream 將 content 切成多個 record 寫出 , 最後會加上一個空的 record 代表 stream 結束
+func WriteStream(w io.Writer, recType uint8, requestID uint16, content []byte) error {
+	for len(content) > 0 {
+		n := len(content)
+		if n > MaxContentLength {
+			n = MaxContentLength
+		}
+		if err := WriteRecord(w, recType, requestID, content[:n]); err != nil {
+			return err
+		}
+		content = content[n:]
+	}
+	return WriteRecord(w, recType, requestID, nil)
+}
+
+// DecodeParams 解析 PARAMS stream 的內容
+func DecodeParams(b []byte) (map[string]string, error) {
+	params := make(map[string]string)
+	for len(b) > 0 {
+		nameLen, n := decodeLength(b)
+		if n == 0 {
+			return nil, ErrInvalidParams
+		}
+		b = b[n:]
+		valueLen, n := decodeLength(b)
+		if n == 0 {
+			return nil, ErrInvalidParams
+		}
+		b = b[n:]
+		if uint32(len(b)) < nameLen+valueLen {
+			return nil, ErrInvalidParams
+		}
+		params[string(b[:nameLen])] = string(b[nameLen : nameLen+valueLen])
+		b = b[nameLen+valueLen:]
+	}
+	return params, nil
+}
+
+// EncodeParams 將 params 編碼為 PARAMS stream 的內容
+func EncodeParams(params map[string]string) []byte {
+	var b []byte
+	for name, value := range params {
+		b = appendLength(b, len(name))
+		b = appendLength(b, len(value))
+		b = append(b, name...)
+		b = append(b, value...)
+	}
+	return b
+}
+
+// decodeLength 返回長度及所佔的 byte 數 , 資料不足時返回 0
+func decodeLength(b []byte) (uint32, int) {
+	if len(b) < 1 {
+		return 0, 0
+	}
+	if b[0]>>7 == 0 {
+		return uint32(b[0]), 1
+	}
+	if len(b) < 4 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint32(b) &^ (1 << 31), 4
+}
+
+func appendLength(b []byte, n int) []byte {
+	if n <= 127 {
+		return append(b, byte(n))
+	}
+	return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
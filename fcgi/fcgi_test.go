@@ -0,0 +1,106 @@
+package fcgi
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParamsRoundTrip(t *testing.T) {
+	params := map[string]string{
+		"SCRIPT_FILENAME": "/var/www/index.php",
+		"EMPTY":           "",
+		"LONG":            strings.Repeat("x", 300),
+	}
+	decoded, err := DecodeParams(EncodeParams(params))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded) != len(params) {
+		t.Fatalf("expected %d params , got %d", len(params), len(decoded))
+	}
+	for k, v := range params {
+		if decoded[k] != v {
+			t.Errorf("param %s : expected %q , got %q", k, v, decoded[k])
+		}
+	}
+
+	if _, err := DecodeParams([]byte{5, 1, 'a'}); err != ErrInvalidParams {
+		t.Errorf("expected ErrInvalidParams , got %v", err)
+	}
+}
+
+func TestWriteStream(t *testing.T) {
+	var buf bytes.Buffer
+	content := bytes.Repeat([]byte("y"), MaxContentLength+10)
+	if err := WriteStream(&buf, TypeStdin, 7, content); err != nil {
+		t.Fatal(err)
+	}
+
+	var rec Record
+	var got []byte
+	for {
+		if err := ReadRecord(&buf, &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Type != TypeStdin || rec.RequestID != 7 {
+			t.Fatalf("unexpected record type %d id %d", rec.Type, rec.RequestID)
+		}
+		if len(rec.Content) == 0 {
+			break
+		}
+		got = append(got, rec.Content...)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("stream content mismatch , got %d bytes", len(got))
+	}
+	if buf.Len() != 0 {
+		t.Errorf("%d bytes left", buf.Len())
+	}
+}
+
+func TestReadHead(t *testing.T) {
+	var buf bytes.Buffer
+	WriteRecord(&buf, TypeGetValues, 0, nil)
+	WriteRecord(&buf, TypeBeginRequest, 1, []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	WriteStream(&buf, TypeParams, 1, EncodeParams(map[string]string{"SERVER_NAME": "php8.example.com"}))
+	headLen := buf.Len()
+	WriteStream(&buf, TypeStdin, 1, []byte("body"))
+	all := append([]byte(nil), buf.Bytes()...)
+
+	head, params, err := ReadHead(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["SERVER_NAME"] != "php8.example.com" {
+		t.Errorf("unexpected params %v", params)
+	}
+	if !bytes.Equal(head, all[:headLen]) {
+		t.Errorf("head should be the raw bytes before STDIN")
+	}
+	if buf.Len() != len(all)-headLen {
+		t.Errorf("ReadHead read past PARAMS , %d bytes left", buf.Len())
+	}
+}
+
+func TestClearKeepConn(t *testing.T) {
+	var buf bytes.Buffer
+	// management record 的 padding 也要跳過
+	WriteRecord(&buf, TypeGetValues, 0, []byte{1, 2, 3})
+	WriteRecord(&buf, TypeBeginRequest, 1, []byte{0, 1, FlagKeepConn, 0, 0, 0, 0, 0})
+	WriteStream(&buf, TypeParams, 1, EncodeParams(map[string]string{"SERVER_NAME": "php8.example.com"}))
+	head, _, err := ReadHead(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ClearKeepConn(head) {
+		t.Error("FCGI_KEEP_CONN should be set")
+	}
+	if ClearKeepConn(head) {
+		t.Error("FCGI_KEEP_CONN should be cleared")
+	}
+	// 清除後仍然是合法的要求
+	if _, params, err := ReadHead(bytes.NewReader(head)); err != nil || params["SERVER_NAME"] != "php8.example.com" {
+		t.Errorf("ReadHead after ClearKeepConn = %v , %v", params, err)
+	}
+}
@@ -0,0 +1,70 @@
+package fcgi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// MaxHeadLength ReadHead 最多讀取的資料量 , 避免 client 送出無止盡的 PARAMS
+const MaxHeadLength = 1024 * 1024
+
+// FlagKeepConn BEGIN_REQUEST 的 FCGI_KEEP_CONN , 回應後不關閉連線 , 之後的要求會在同一個連線上送出
+const FlagKeepConn uint8 = 1
+
+// ErrHeadTooLong 第一個要求的 BEGIN_REQUEST 及 PARAMS 超過 MaxHeadLength
+var ErrHeadTooLong = errors.New("fcgi: request head too long")
+
+// ReadHead 讀取連線上第一個要求的 BEGIN_REQUEST 及完整的 PARAMS stream
+// 返回讀到的原始資料 (包含之前的 management record) 及解析後的 params
+// 原始資料必須在連線其餘的資料之前原封不動地轉送出去
+func ReadHead(r io.Reader) (head []byte, params map[string]string, err error) {
+	var raw bytes.Buffer
+	tee := io.TeeReader(r, &raw)
+	var rec Record
+	var content []byte
+	var requestID uint16
+	begun := false
+	for {
+		if err = ReadRecord(tee, &rec); err != nil {
+			return nil, nil, err
+		}
+		if raw.Len() > MaxHeadLength {
+			return nil, nil, ErrHeadTooLong
+		}
+		switch {
+		case rec.Type == TypeBeginRequest && !begun:
+			begun = true
+			requestID = rec.RequestID
+		case rec.Type == TypeParams && begun && rec.RequestID == requestID:
+			if rec.ContentLength == 0 {
+				if params, err = DecodeParams(content); err != nil {
+					return nil, nil, err
+				}
+				return raw.Bytes(), params, nil
+			}
+			content = append(content, rec.Content...)
+		}
+	}
+}
+
+// ClearKeepConn 清除 head 中 BEGIN_REQUEST 的 FCGI_KEEP_CONN , php-cgi 回應後就會關閉連線
+// 返回原本是否設定了 FCGI_KEEP_CONN , head 必須是 ReadHead 返回的資料
+func ClearKeepConn(head []byte) bool {
+	for off := 0; off+HeaderLength <= len(head); {
+		contentLength := int(binary.BigEndian.Uint16(head[off+4:]))
+		if head[off+1] == TypeBeginRequest {
+			// role (2 bytes) 之後是 flags
+			flags := off + HeaderLength + 2
+			if contentLength < 8 || flags >= len(head) {
+				return false
+			}
+			keepConn := head[flags]&FlagKeepConn != 0
+			head[flags] &^= FlagKeepConn
+			return keepConn
+		}
+		off += HeaderLength + contentLength + int(head[off+6])
+	}
+	return false
+}
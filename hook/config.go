@@ -0,0 +1,59 @@
+package hook
+
+import (
+	"fmt"
+	"time"
+
+	"wphpfpm/conf"
+)
+
+// defaultRetries 設定檔沒有設定 Retries 時的重試次數
+const defaultRetries = 3
+
+// New 依據設定檔的 Hooks 建立 Bus , 每個 Hook 為一個 Sink
+func New(hooks []conf.Hook) (*Bus, error) {
+	type entry struct {
+		name string
+		sink Sink
+		opts Options
+	}
+	// 全部檢查完才加入 , 避免返回錯誤時留下執行中的 goroutine
+	entries := make([]entry, 0, len(hooks))
+	for i, h := range hooks {
+		opts := Options{
+			Timeout:   time.Duration(h.Timeout) * time.Second,
+			Debounce:  time.Duration(h.Debounce) * time.Second,
+			Retries:   h.Retries,
+			QueueSize: h.QueueSize,
+		}
+		if opts.Retries == 0 {
+			opts.Retries = defaultRetries
+		} else if opts.Retries < 0 {
+			opts.Retries = 0
+		}
+		for _, name := range h.Events {
+			t, err := ParseType(name)
+			if err != nil {
+				return nil, fmt.Errorf("Hooks #%d : %s", i, err.Error())
+			}
+			opts.Events = append(opts.Events, t)
+		}
+		var (
+			sink Sink
+			name string
+		)
+		if len(h.Command) > 0 {
+			s := &ExecSink{Command: h.Command}
+			sink, name = s, s.String()
+		} else {
+			s := &WebhookSink{URL: h.URL, Headers: h.Headers}
+			sink, name = s, s.String()
+		}
+		entries = append(entries, entry{name: fmt.Sprintf("#%d (%s)", i, name), sink: sink, opts: opts})
+	}
+	b := NewBus()
+	for _, e := range entries {
+		b.Add(e.name, e.sink, e.opts)
+	}
+	return b, nil
+}
@@ -0,0 +1,58 @@
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// maxCommandOutput 命令失敗時 , 錯誤訊息最多包含的輸出長度
+const maxCommandOutput = 512
+
+// ExecSink 每個事件執行一次命令 , 事件以 JSON 由 stdin 傳入
+// 也會設定 WPHPFPM_EVENT , WPHPFPM_SOURCE 及 WPHPFPM_MESSAGE 環境變數 , 結束代碼不是 0 時視為失敗
+type ExecSink struct {
+	Command []string
+}
+
+// Send 執行命令 , ctx 結束時終止命令
+func (s *ExecSink) Send(ctx context.Context, e Event) error {
+	if len(s.Command) == 0 {
+		return errors.New("command is empty")
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, s.Command[0], s.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Env = append(os.Environ(),
+		"WPHPFPM_EVENT="+string(e.Type),
+		"WPHPFPM_SOURCE="+e.Source,
+		"WPHPFPM_MESSAGE="+e.Message,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.TrimSpace(out)
+		if len(out) > maxCommandOutput {
+			out = out[:maxCommandOutput]
+		}
+		if len(out) > 0 {
+			return fmt.Errorf("%s : %s", err.Error(), out)
+		}
+		return err
+	}
+	return nil
+}
+
+// String 返回命令名稱 , 用於 log , 不包含可能有 secret 的參數
+func (s *ExecSink) String() string {
+	if len(s.Command) == 0 {
+		return "exec"
+	}
+	return "exec " + s.Command[0]
+}
@@ -0,0 +1,41 @@
+//go:build !windows
+// +build !windows
+
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "event.json")
+
+	sink := &ExecSink{Command: []string{"sh", "-c", `cat > "$0" && test "$WPHPFPM_EVENT" = process.crashed`, out}}
+	if err := sink.Send(context.Background(), Event{Type: ProcessCrashed, Source: "a", PID: 42}); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e Event
+	if err := json.Unmarshal(b, &e); err != nil || e.PID != 42 || e.Source != "a" {
+		t.Errorf("unexpected event %s (%v)", b, err)
+	}
+
+	sink = &ExecSink{Command: []string{"sh", "-c", "echo broken >&2 ; exit 3"}}
+	if err := sink.Send(context.Background(), Event{Type: ProcessCrashed}); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("expected error with command output , got %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+// Package hook 將 php-cgi pool 及 Server 發生的事件 , 送到執行命令或 webhook 等 Sink
+package hook
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Type 事件的種類
+type Type string
+
+const (
+	// ProcessCrashed php-cgi 異常結束 (不是 Release 或 Stop 要求的)
+	ProcessCrashed Type = "process.crashed"
+	// RestartFailed php-cgi 無法重新啟動 , 該 php-cgi 不再被監控
+	RestartFailed Type = "process.restart_failed"
+	// ProcessUnhealthy php-cgi warmup 失敗 , 延遲後才重新啟動
+	ProcessUnhealthy Type = "process.unhealthy"
+	// PoolExhausted 沒有 idle 的 php-cgi 可以處理要求
+	PoolExhausted Type = "pool.exhausted"
+	// RateLimited 要求超過 RateLimit 被拒絕
+	RateLimited Type = "pool.rate_limited"
+	// ClientRejected 連線不在 AllowedClients 中被拒絕
+	ClientRejected Type = "client.rejected"
+	// ClientThrottled 連線超過 MaxConnectionsPerClient 被關閉
+	ClientThrottled Type = "client.throttled"
+	// ServiceStopped 服務停止
+	ServiceStopped Type = "service.stopped"
+)
+
+// Types 所有的事件種類
+var Types = []Type{ProcessCrashed, RestartFailed, ProcessUnhealthy, PoolExhausted, RateLimited, ClientRejected, ClientThrottled, ServiceStopped}
+
+// highRateTypes 每個要求或連線都可能發生的事件 , Debounce 為 0 時仍以 defaultHighRateDebounce 合併 , 避免每個要求都執行一次命令
+var highRateTypes = map[Type]bool{PoolExhausted: true, RateLimited: true, ClientRejected: true, ClientThrottled: true}
+
+// Event 送給 Sink 的事件 , 以 JSON 送出
+type Event struct {
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Host string    `json:"host"`
+	// Source 發生事件的 Instance (Name , Bind 或 ExecPath) 或 Server 的 Name (沒有設定時為 BindAddress)
+	Source  string `json:"source"`
+	Message string `json:"message"`
+	PID     int    `json:"pid,omitempty"`
+	Client  string `json:"client,omitempty"`
+	// Repeated Debounce 期間被合併 , 沒有另外送出的次數
+	Repeated int `json:"repeated,omitempty"`
+}
+
+// Sink 接收事件 , 返回錯誤時依 Options 重試
+type Sink interface {
+	Send(ctx context.Context, e Event) error
+}
+
+// Options Sink 的送出方式
+type Options struct {
+	// Events 要送出的事件 , 空的代表全部
+	Events []Type
+	// Timeout 每次 Send 的期限 , 0 代表 defaultTimeout
+	Timeout time.Duration
+	// Debounce 同一個 Source 的同一種事件 , 此期間內只送出一次 , 之後的合併為一個 Repeated 事件
+	// 0 代表每次都送出 , 但 highRateTypes 的事件使用 defaultHighRateDebounce
+	Debounce time.Duration
+	// Retries 失敗時重試的次數 , 0 代表不重試
+	Retries int
+	// RetryInterval 第一次重試前等待的時間 , 之後每次加倍 , 0 代表 defaultRetryInterval
+	RetryInterval time.Duration
+	// QueueSize 等待送出及重試的事件上限 , 超過時丟棄最舊的 , 0 代表 defaultQueueSize
+	QueueSize int
+}
+
+const (
+	defaultTimeout       = 10 * time.Second
+	defaultRetryInterval = time.Second
+	defaultQueueSize     = 100
+	maxRetryInterval     = time.Minute
+	// defaultHighRateDebounce Debounce 為 0 時 highRateTypes 事件的 Debounce
+	defaultHighRateDebounce = 10 * time.Second
+	// queueFullLogInterval 佇列已滿的警告最多每隔這段時間記錄一次
+	queueFullLogInterval = 10 * time.Second
+)
+
+// Bus 將 Publish 的事件分送給所有的 Sink , 每個 Sink 有自己的 debounce 及重試佇列
+// nil 的 *Bus 也可以呼叫 Publish , 不做任何事
+type Bus struct {
+	host  string
+	sinks []*runner
+}
+
+// NewBus 建立沒有 Sink 的 Bus , 以 Add 加入 Sink
+func NewBus() *Bus {
+	host, _ := os.Hostname()
+	return &Bus{host: host}
+}
+
+// Add 加入 Sink 並開始送出事件 , 必須在第一次 Publish 之前呼叫
+func (b *Bus) Add(name string, s Sink, opts Options) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultTimeout
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = defaultRetryInterval
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = defaultQueueSize
+	}
+	r := &runner{
+		name:     name,
+		sink:     s,
+		opts:     opts,
+		debounce: make(map[string]*debounceState),
+		wake:     make(chan struct{}, 1),
+		abort:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if len(opts.Events) > 0 {
+		r.types = make(map[Type]bool)
+		for _, t := range opts.Events {
+			r.types[t] = true
+		}
+	}
+	b.sinks = append(b.sinks, r)
+	go r.loop()
+}
+
+// Publish 將事件送進每個 Sink 的佇列 , 不會等待送出 , Time 及 Host 沒有設定時自動填入
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if e.Host == "" {
+		e.Host = b.host
+	}
+	for _, r := range b.sinks {
+		r.publish(e)
+	}
+}
+
+// Close 不再接受新的事件 , 並等待佇列中的事件送出 , ctx 先結束時放棄剩下的事件並返回 ctx.Err()
+func (b *Bus) Close(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	for _, r := range b.sinks {
+		r.close()
+	}
+	for _, r := range b.sinks {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			for _, r := range b.sinks {
+				r.stop()
+			}
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// delivery 佇列中等待送出的事件
+type delivery struct {
+	event    Event
+	attempts int       // 已經失敗的次數
+	next     time.Time // 下次可以送出的時間
+}
+
+// debounceState 同一個 Source 的同一種事件最後一次送出的狀態
+type debounceState struct {
+	last       time.Time
+	suppressed int
+	latest     Event
+	timer      *time.Timer
+}
+
+// runner 負責單一 Sink 的 debounce 及重試佇列 , 以一個 goroutine 依序送出
+type runner struct {
+	name  string
+	sink  Sink
+	opts  Options
+	types map[Type]bool // nil 代表全部
+
+	mutex     sync.Mutex
+	queue     []*delivery
+	debounce  map[string]*debounceState
+	closed    bool
+	abortOnce sync.Once
+	dropped   int       // 上次記錄佇列已滿之後丟棄的事件數量
+	droppedAt time.Time // 上次記錄佇列已滿的時間
+
+	wake  chan struct{} // 佇列有變化時通知 loop
+	abort chan struct{} // Close 逾時 , loop 立即結束
+	done  chan struct{} // loop 已經結束
+}
+
+// logger 返回帶有 hook , event 及 instance 欄位的 log entry
+func (r *runner) logger(e Event) *log.Entry {
+	return log.WithFields(log.Fields{"hook": r.name, "event": e.Type, "instance": e.Source})
+}
+
+// publish 依 Events 及 Debounce 決定是否放進佇列
+func (r *runner) publish(e Event) {
+	if r.types != nil && !r.types[e.Type] {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return
+	}
+	if debounce := r.debounceOf(e.Type); debounce > 0 {
+		key := string(e.Type) + "|" + e.Source
+		state := r.debounce[key]
+		if state == nil {
+			state = &debounceState{}
+			r.debounce[key] = state
+		}
+		if elapsed := e.Time.Sub(state.last); elapsed < debounce {
+			state.suppressed++
+			state.latest = e
+			if state.timer == nil {
+				state.timer = time.AfterFunc(debounce-elapsed, func() {
+					r.mutex.Lock()
+					r.flush(state)
+					r.mutex.Unlock()
+				})
+			}
+			return
+		}
+		state.last = e.Time
+	}
+	r.enqueue(e)
+}
+
+// debounceOf 返回事件種類的 Debounce
+func (r *runner) debounceOf(t Type) time.Duration {
+	if r.opts.Debounce == 0 && highRateTypes[t] {
+		return defaultHighRateDebounce
+	}
+	return r.opts.Debounce
+}
+
+// flush 送出 Debounce 期間合併的事件 , 必須持有 mutex
+func (r *runner) flush(state *debounceState) {
+	if state.timer != nil {
+		state.timer.Stop()
+		state.timer = nil
+	}
+	if state.suppressed == 0 {
+		return
+	}
+	e := state.latest
+	e.Repeated = state.suppressed
+	state.suppressed = 0
+	state.last = time.Now()
+	r.enqueue(e)
+}
+
+// enqueue 放進佇列 , 超過 QueueSize 時丟棄最舊的 , 必須持有 mutex
+// 丟棄時每 queueFullLogInterval 最多記錄一次 , 並記錄這段期間丟棄的數量
+func (r *runner) enqueue(e Event) {
+	if len(r.queue) >= r.opts.QueueSize {
+		dropped := r.queue[0]
+		r.queue = r.queue[1:]
+		r.dropped++
+		if now := time.Now(); now.Sub(r.droppedAt) >= queueFullLogInterval {
+			r.logger(dropped.event).WithField("dropped", r.dropped).Warn("Hook queue is full , event dropped")
+			r.dropped = 0
+			r.droppedAt = now
+		}
+	}
+	r.queue = append(r.queue, &delivery{event: e})
+	r.notify()
+}
+
+// notify 喚醒 loop
+func (r *runner) notify() {
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// close 送出 Debounce 中合併的事件 , 之後不再接受新的事件 , loop 送完佇列後結束
+func (r *runner) close() {
+	r.mutex.Lock()
+	if !r.closed {
+		for _, state := range r.debounce {
+			r.flush(state)
+		}
+		r.closed = true
+	}
+	r.notify()
+	r.mutex.Unlock()
+}
+
+// stop 放棄佇列中的事件 , loop 立即結束
+func (r *runner) stop() {
+	r.abortOnce.Do(func() { close(r.abort) })
+}
+
+// next 取出可以送出的事件 , 沒有時返回需要等待的時間 , 佇列已空且已經 close 時 finished 為 true
+func (r *runner) next(now time.Time) (d *delivery, wait time.Duration, finished bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.queue) == 0 {
+		return nil, 0, r.closed
+	}
+	for i, item := range r.queue {
+		if !item.next.After(now) {
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			return item, 0, false
+		}
+		if w := item.next.Sub(now); wait == 0 || w < wait {
+			wait = w
+		}
+	}
+	return nil, wait, false
+}
+
+// loop 依序送出佇列中的事件 , 失敗的依 Retries 延後重試
+func (r *runner) loop() {
+	defer close(r.done)
+	for {
+		d, wait, finished := r.next(time.Now())
+		if finished {
+			return
+		}
+		if d == nil {
+			var timer *time.Timer
+			var timeout <-chan time.Time
+			if wait > 0 {
+				timer = time.NewTimer(wait)
+				timeout = timer.C
+			}
+			select {
+			case <-r.wake:
+			case <-timeout:
+			case <-r.abort:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			select {
+			case <-r.abort:
+				return
+			default:
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), r.opts.Timeout)
+		err := r.sink.Send(ctx, d.event)
+		cancel()
+		if err == nil {
+			if log.IsLevelEnabled(log.DebugLevel) {
+				r.logger(d.event).Debug("Hook event sent")
+			}
+			continue
+		}
+		d.attempts++
+		if d.attempts > r.opts.Retries {
+			r.logger(d.event).WithField("attempts", d.attempts).WithError(err).Error("Hook can not send event , dropped")
+			continue
+		}
+		d.next = time.Now().Add(retryInterval(r.opts.RetryInterval, d.attempts))
+		r.logger(d.event).WithField("attempts", d.attempts).WithError(err).Warn("Hook can not send event , retry later")
+		r.mutex.Lock()
+		r.queue = append(r.queue, d)
+		r.mutex.Unlock()
+	}
+}
+
+// retryInterval 第 attempts 次失敗後等待的時間 , 每次加倍 , 最多 maxRetryInterval
+func retryInterval(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxRetryInterval; i++ {
+		d *= 2
+	}
+	if d > maxRetryInterval {
+		d = maxRetryInterval
+	}
+	return d
+}
+
+// ParseType 檢查事件名稱 , 返回對應的 Type
+func ParseType(name string) (Type, error) {
+	for _, t := range Types {
+		if string(t) == name {
+			return t, nil
+		}
+	}
+	return "", fmt.Errorf("unknown event %s", name)
+}
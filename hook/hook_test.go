@@ -0,0 +1,232 @@
+package hook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"wphpfpm/conf"
+)
+
+// recordSink 記錄收到的事件 , 前 failures 次返回錯誤
+type recordSink struct {
+	mutex    sync.Mutex
+	failures int
+	calls    int
+	events   []Event
+}
+
+func (s *recordSink) Send(ctx context.Context, e Event) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.calls++
+	if s.calls <= s.failures {
+		return errors.New("unavailable")
+	}
+	s.events = append(s.events, e)
+	return nil
+}
+
+func (s *recordSink) received() []Event {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+func closeBus(t *testing.T, b *Bus) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBusRetry(t *testing.T) {
+	sink := &recordSink{failures: 2}
+	b := NewBus()
+	b.Add("test", sink, Options{Retries: 2, RetryInterval: 10 * time.Millisecond})
+	b.Publish(Event{Type: ProcessCrashed, Source: "a"})
+	closeBus(t, b)
+
+	events := sink.received()
+	if len(events) != 1 || events[0].Type != ProcessCrashed || events[0].Time.IsZero() {
+		t.Fatalf("expected 1 process.crashed event , got %+v", events)
+	}
+	if sink.calls != 3 {
+		t.Errorf("expected 3 attempts , got %d", sink.calls)
+	}
+
+	// 超過重試次數的事件被丟棄
+	sink = &recordSink{failures: 5}
+	b = NewBus()
+	b.Add("test", sink, Options{Retries: 1, RetryInterval: 10 * time.Millisecond})
+	b.Publish(Event{Type: ProcessCrashed, Source: "a"})
+	closeBus(t, b)
+	if len(sink.received()) != 0 || sink.calls != 2 {
+		t.Errorf("expected 2 failed attempts , got %d calls and %d events", sink.calls, len(sink.received()))
+	}
+}
+
+func TestBusDebounce(t *testing.T) {
+	sink := &recordSink{}
+	b := NewBus()
+	b.Add("test", sink, Options{Debounce: 100 * time.Millisecond, Events: []Type{PoolExhausted}})
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Type: PoolExhausted, Source: "a"})
+	}
+	b.Publish(Event{Type: PoolExhausted, Source: "b"})
+	// 不在 Events 中的事件不會送出
+	b.Publish(Event{Type: ProcessCrashed, Source: "a"})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.received()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	closeBus(t, b)
+
+	events := sink.received()
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events , got %+v", events)
+	}
+	repeated := map[string]int{}
+	for _, e := range events {
+		if e.Type != PoolExhausted {
+			t.Errorf("unexpected event %s", e.Type)
+		}
+		repeated[e.Source] += e.Repeated
+	}
+	if repeated["a"] != 2 || repeated["b"] != 0 {
+		t.Errorf("expected 2 repeated events from a , got %v", repeated)
+	}
+}
+
+func TestBusQueueSize(t *testing.T) {
+	sink := &blockSink{start: make(chan struct{}), block: make(chan struct{}), sent: make(chan Event, 10)}
+	b := NewBus()
+	b.Add("test", sink, Options{QueueSize: 2})
+	b.Publish(Event{Type: ProcessCrashed, Message: "1"})
+	<-sink.start
+	// 第一個事件送出中 , 佇列只保留最新的 2 個
+	for _, m := range []string{"2", "3", "4"} {
+		b.Publish(Event{Type: ProcessCrashed, Message: m})
+	}
+	close(sink.block)
+	closeBus(t, b)
+	close(sink.sent)
+	var messages []string
+	for e := range sink.sent {
+		messages = append(messages, e.Message)
+	}
+	if len(messages) != 3 || messages[0] != "1" || messages[1] != "3" || messages[2] != "4" {
+		t.Errorf("expected events 1 , 3 , 4 , got %v", messages)
+	}
+}
+
+func TestBusHighRateDebounce(t *testing.T) {
+	sink := &recordSink{}
+	b := NewBus()
+	b.Add("test", sink, Options{})
+	// Debounce 為 0 時 , 每個要求都可能發生的事件仍然被合併 , 其他事件每次都送出
+	for i := 0; i < 3; i++ {
+		b.Publish(Event{Type: ClientRejected, Source: "a", Client: "10.0.0.1"})
+		b.Publish(Event{Type: ProcessCrashed, Source: "a"})
+	}
+	closeBus(t, b)
+
+	count := map[Type]int{}
+	repeated := 0
+	for _, e := range sink.received() {
+		count[e.Type]++
+		repeated += e.Repeated
+	}
+	if count[ClientRejected] != 2 || repeated != 2 || count[ProcessCrashed] != 3 {
+		t.Errorf("expected 2 client.rejected (2 repeated) and 3 process.crashed , got %v , repeated %d", count, repeated)
+	}
+}
+
+func TestBusQueueFullLog(t *testing.T) {
+	sink := &blockSink{start: make(chan struct{}), block: make(chan struct{}), sent: make(chan Event, 10)}
+	b := NewBus()
+	b.Add("test", sink, Options{QueueSize: 1})
+	b.Publish(Event{Type: ProcessCrashed, Message: "1"})
+	<-sink.start
+	for _, m := range []string{"2", "3", "4", "5"} {
+		b.Publish(Event{Type: ProcessCrashed, Message: m})
+	}
+	// 第一次丟棄時記錄 , 之後 queueFullLogInterval 內的只計數
+	r := b.sinks[0]
+	r.mutex.Lock()
+	dropped := r.dropped
+	r.mutex.Unlock()
+	if dropped != 2 {
+		t.Errorf("expected 2 dropped events waiting to be logged , got %d", dropped)
+	}
+	close(sink.block)
+	closeBus(t, b)
+}
+
+// blockSink 第一次 Send 時關閉 start , 並等待 block 關閉
+type blockSink struct {
+	once  sync.Once
+	start chan struct{}
+	block chan struct{}
+	sent  chan Event
+}
+
+func (s *blockSink) Send(ctx context.Context, e Event) error {
+	s.once.Do(func() { close(s.start) })
+	<-s.block
+	s.sent <- e
+	return nil
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan Event, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- e
+	}))
+	defer ts.Close()
+
+	b, err := New([]conf.Hook{{URL: ts.URL + "/hook?key=secret", Headers: map[string]string{"Authorization": "Bearer token"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := b.sinks[0].name; name != "#0 (webhook "+ts.URL+"/hook)" {
+		t.Errorf("sink name should not contain query , got %s", name)
+	}
+	b.Publish(Event{Type: ServiceStopped, Source: "wphpfpm", Message: "Service stopped"})
+	closeBus(t, b)
+	select {
+	case e := <-received:
+		if e.Type != ServiceStopped || e.Message != "Service stopped" || e.Host == "" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Fatal("webhook is not called")
+	}
+
+	sink := &WebhookSink{URL: ts.URL}
+	if err := sink.Send(context.Background(), Event{Type: ServiceStopped}); err == nil {
+		t.Error("expected error for 401 response")
+	}
+}
+
+func TestNewInvalidEvent(t *testing.T) {
+	if _, err := New([]conf.Hook{{URL: "http://127.0.0.1/", Events: []string{"process.exploded"}}}); err == nil {
+		t.Error("expected error for unknown event")
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultTimeFormat 沒有設定 TimeFormat 時 log 的時間格式
+const defaultTimeFormat = "2006-01-02 15:04:05 -0700"
+
+// namedTimeFormats TimeFormat 除了 Go 的 time layout , 也可以使用這些名稱
+var namedTimeFormats = map[string]string{
+	"RFC3339":     time.RFC3339,
+	"RFC3339Nano": time.RFC3339Nano,
+	"RFC1123":     time.RFC1123,
+	"Unix":        time.UnixDate,
+}
+
+// newFormatter 依據 LogFormat (text , logfmt 或 json) 及 TimeFormat 建立 logrus 的 Formatter
+func newFormatter(format string, timeFormat string) log.Formatter {
+	if layout, ok := namedTimeFormats[timeFormat]; ok {
+		timeFormat = layout
+	} else if timeFormat == "" {
+		timeFormat = defaultTimeFormat
+	}
+	switch format {
+	case "json":
+		return &log.JSONFormatter{TimestampFormat: timeFormat}
+	case "logfmt":
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: timeFormat}
+	default:
+		return &MyTextFormatter{timeFormat: timeFormat}
+	}
+}
+
+// MyTextFormatter logrus custom formatter
+// 輸出 時間 [level]: message , 之後依 key 排序附加 key=value 欄位
+type MyTextFormatter struct {
+	timeFormat string
+}
+
+// Format logrus custom format
+func (f *MyTextFormatter) Format(entry *log.Entry) ([]byte, error) {
+	var b *bytes.Buffer
+	if entry.Buffer != nil {
+		b = entry.Buffer
+	} else {
+		b = &bytes.Buffer{}
+	}
+	b.WriteString(entry.Time.Format(f.timeFormat))
+	b.WriteString(" [")
+	b.WriteString(entry.Level.String())
+	b.WriteString("]: ")
+	b.WriteString(entry.Message)
+	if len(entry.Data) > 0 {
+		keys := make([]string, 0, len(entry.Data))
+		for k := range entry.Data {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			b.WriteByte(' ')
+			b.WriteString(k)
+			b.WriteByte('=')
+			writeFieldValue(b, entry.Data[k])
+		}
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// writeFieldValue 寫入欄位的值 , 包含空白 , 引號或 = 的值以引號括起來
+func writeFieldValue(b *bytes.Buffer, v interface{}) {
+	var s string
+	switch value := v.(type) {
+	case string:
+		s = value
+	case error:
+		s = value.Error()
+	default:
+		s = fmt.Sprint(value)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		fmt.Fprintf(b, "%q", s)
+		return
+	}
+	b.WriteString(s)
+}
@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"strings"
 	"testing"
+	"time"
 	"unsafe"
 
 	log "github.com/sirupsen/logrus"
@@ -135,3 +138,40 @@ func BenchmarkFormatBuilderUnsafe(b *testing.B) {
 		log.Debugf("%d This is a test message blah blah blah blah blah blah blah blah blah blah ...", i)
 	}
 }
+
+func TestNewFormatter(t *testing.T) {
+	entry := log.WithFields(log.Fields{"instance": "site1", "pid": 42, "pipe": "/tmp/php cgi.sock"}).WithError(errors.New("broken pipe"))
+	entry.Time = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	entry.Level = log.ErrorLevel
+	entry.Message = "php-cgi exit error"
+
+	b, err := newFormatter("", "").Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `2020-01-02 03:04:05 +0000 [error]: php-cgi exit error error="broken pipe" instance=site1 pid=42 pipe="/tmp/php cgi.sock"` + "\n"
+	if string(b) != expected {
+		t.Errorf("text : expected %q , got %q", expected, b)
+	}
+
+	entry.Buffer = nil
+	b, err = newFormatter("logfmt", "RFC3339").Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), `time="2020-01-02T03:04:05Z" level=error msg="php-cgi exit error"`) || !strings.Contains(string(b), "pid=42") {
+		t.Errorf("logfmt : unexpected %q", b)
+	}
+
+	b, err = newFormatter("json", "2006-01-02").Format(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(b, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["time"] != "2020-01-02" || fields["instance"] != "site1" || fields["pid"] != float64(42) || fields["error"] != "broken pipe" {
+		t.Errorf("json : unexpected %s", b)
+	}
+}
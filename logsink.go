@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wphpfpm/conf"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logSink 一個 log 輸出 , 以 logrus hook 接收自己 Level 以上的 entry , 用自己的 formatter 輸出
+// logrus 本身的 Out 設為 ioutil.Discard , 所有輸出都經由 logSink
+type logSink struct {
+	name      string
+	level     log.Level
+	formatter log.Formatter // syslog 使用 text 格式時為 nil , 只送出 message , 欄位放在 STRUCTURED-DATA
+
+	mutex  sync.Mutex
+	out    io.Writer     // stdout , stderr 或 lumberjack
+	syslog *syslogWriter // Type 為 syslog 時不是 nil
+	closed bool          // syslog 已經 close , 不再接受新的訊息
+}
+
+// newLogSink 依據 Logger 設定建立輸出 , Level 及 Format 沒有設定時使用 LogLevel 及 LogFormat
+func newLogSink(logger *conf.Logger, level log.Level, config *conf.Conf) (*logSink, error) {
+	s := &logSink{level: level}
+	if logger.Level != "" {
+		var err error
+		if s.level, err = log.ParseLevel(logger.Level); err != nil {
+			return nil, err
+		}
+	}
+	format := logger.Format
+	if format == "" {
+		format = config.LogFormat
+	}
+	s.formatter = newFormatter(format, config.TimeFormat)
+
+	switch logger.SinkType() {
+	case "stdout":
+		s.name, s.out = "stdout", os.Stdout
+	case "stderr":
+		s.name, s.out = "console (stderr)", os.Stderr
+	case "file":
+		if logDir := filepath.Dir(logger.Filename); logDir == "." || logDir == "" {
+			// 如果 Filename 沒指定路徑，修正為 exe 的路徑
+			exeDir, err := filepath.Abs(filepath.Dir(os.Args[0]))
+			if err != nil {
+				return nil, err
+			}
+			logger.Filename = filepath.Join(exeDir, logger.Filename)
+		}
+		s.name = "file " + logger.Filename
+		s.out = &lumberjack.Logger{
+			Filename:   logger.Filename,
+			MaxSize:    logger.MaxSize,
+			MaxBackups: logger.MaxBackups,
+			MaxAge:     logger.MaxAge,
+			Compress:   logger.Compress,
+		}
+	case "syslog":
+		network, address, err := logger.SyslogAddress()
+		if err != nil {
+			return nil, err
+		}
+		s.syslog = newSyslogWriter(network, address, logger.Facility, logger.Tag)
+		go s.syslog.loop()
+		s.name = "syslog " + network + ":" + address
+		if format == "" || format == "text" {
+			s.formatter = nil
+		}
+	default:
+		return nil, fmt.Errorf("Type %s is invalid", logger.Type)
+	}
+	return s, nil
+}
+
+// Levels 實作 logrus.Hook , 返回 s.level 以上的等級
+func (s *logSink) Levels() []log.Level {
+	return log.AllLevels[:s.level+1]
+}
+
+// Fire 實作 logrus.Hook , 格式化 entry 後寫入輸出
+func (s *logSink) Fire(entry *log.Entry) error {
+	var b []byte
+	if s.formatter != nil {
+		var err error
+		if b, err = s.formatter.Format(entry); err != nil {
+			return err
+		}
+	}
+	if s.syslog != nil {
+		if b == nil {
+			b = []byte(entry.Message)
+		}
+		// Fire 在 logrus 的 mutex 中執行 , 連線及寫入交給 loop , 避免 syslog 無法連線時卡住所有的 log
+		msg := s.syslog.format(entry, bytes.TrimRight(b, "\n"))
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if !s.closed {
+			s.syslog.enqueue(msg)
+		}
+		return nil
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	_, err := s.out.Write(b)
+	return err
+}
+
+// close 等待 syslog 送出佇列中的訊息 , 最多等待 timeout , 之後的 log 不再送出
+func (s *logSink) close(timeout time.Duration) {
+	if s.syslog == nil {
+		return
+	}
+	s.mutex.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.syslog.queue)
+	}
+	s.mutex.Unlock()
+	select {
+	case <-s.syslog.done:
+	case <-time.After(timeout):
+	}
+}
+
+// nopFormatter 所有輸出都經由 logSink , logrus 本身不需要再格式化一次
+type nopFormatter struct{}
+
+// Format 不輸出任何內容
+func (nopFormatter) Format(*log.Entry) ([]byte, error) {
+	return nil, nil
+}
+
+const (
+	syslogDialTimeout   = 5 * time.Second
+	syslogWriteTimeout  = 5 * time.Second
+	syslogRetryInterval = 10 * time.Second // 連線失敗後 , 這段時間內的 log 直接丟棄 , 避免每一行都等待逾時
+	syslogQueueSize     = 1000             // 等待送出的訊息上限 , 超過時丟棄並計數
+	syslogTimeFormat    = "2006-01-02T15:04:05.000000Z07:00"
+	syslogSDID          = "wphpfpm@32473" // 32473 為 RFC 5612 保留給文件範例的 enterprise number
+)
+
+// syslogSeverities logrus 等級對應的 syslog severity , panic 及 fatal 只影響 wphpfpm 本身 , 所以不使用 emerg
+var syslogSeverities = [...]int{
+	log.PanicLevel: 2,
+	log.FatalLevel: 2,
+	log.ErrorLevel: 3,
+	log.WarnLevel:  4,
+	log.InfoLevel:  6,
+	log.DebugLevel: 7,
+	log.TraceLevel: 7,
+}
+
+// syslogWriter 以 RFC 5424 格式送出 syslog , unixgram 及 udp 每個 datagram 一筆 , tcp 使用 octet counting (RFC 6587)
+type syslogWriter struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+	tag      string
+	pid      int
+
+	conn  net.Conn
+	retry time.Time // 連線失敗時 , 這個時間之前不重新連線
+
+	queue    chan []byte   // format 過的訊息 , 由 loop 送出
+	done     chan struct{} // queue 關閉且 loop 已經結束
+	dropped  uint64        // 無法送出或佇列已滿而丟棄的訊息數量 , 以 atomic 存取
+	reported time.Time     // 上次將錯誤輸出到 stderr 的時間
+}
+
+// newSyslogWriter 建立 syslogWriter , 第一次寫入時才連線
+func newSyslogWriter(network string, address string, facility string, tag string) *syslogWriter {
+	w := &syslogWriter{network: network, address: address, facility: 3, tag: tag, pid: os.Getpid(),
+		queue: make(chan []byte, syslogQueueSize), done: make(chan struct{})}
+	if code, ok := conf.SyslogFacilities[facility]; ok {
+		w.facility = code
+	}
+	if w.tag == "" {
+		w.tag = "wphpfpm"
+	}
+	if w.hostname, _ = os.Hostname(); w.hostname == "" {
+		w.hostname = "-"
+	}
+	return w
+}
+
+// enqueue 將訊息放進佇列 , 佇列已滿時丟棄 , 不會等待
+func (w *syslogWriter) enqueue(msg []byte) {
+	select {
+	case w.queue <- msg:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// loop 依序送出佇列中的訊息 , 直到 queue 被關閉
+// 丟棄的訊息在下次送出成功前 , 以一筆 warning 告知 syslog 的數量
+func (w *syslogWriter) loop() {
+	defer close(w.done)
+	for msg := range w.queue {
+		if n := atomic.LoadUint64(&w.dropped); n > 0 && w.connect() == nil {
+			entry := &log.Entry{Time: time.Now(), Level: log.WarnLevel, Data: log.Fields{"dropped": n}}
+			if err := w.send(w.format(entry, []byte("syslog messages were dropped"))); err == nil {
+				atomic.AddUint64(&w.dropped, ^(n - 1))
+			}
+		}
+		if err := w.send(msg); err != nil {
+			atomic.AddUint64(&w.dropped, 1)
+			w.report(err)
+		}
+	}
+}
+
+// report 將送出失敗的原因輸出到 stderr , 每 syslogRetryInterval 最多一次 , 不能經由 logrus 避免遞迴
+func (w *syslogWriter) report(err error) {
+	if time.Since(w.reported) < syslogRetryInterval {
+		return
+	}
+	w.reported = time.Now()
+	fmt.Fprintf(os.Stderr, "syslog %s:%s : %s , %d messages dropped\n", w.network, w.address, err.Error(), atomic.LoadUint64(&w.dropped))
+}
+
+// connect 連線 syslog , 已經連線時不做任何事
+func (w *syslogWriter) connect() error {
+	if w.conn != nil {
+		return nil
+	}
+	if time.Now().Before(w.retry) {
+		return fmt.Errorf("syslog %s:%s is unavailable", w.network, w.address)
+	}
+	conn, err := net.DialTimeout(w.network, w.address, syslogDialTimeout)
+	if err != nil {
+		w.retry = time.Now().Add(syslogRetryInterval)
+		return err
+	}
+	w.conn = conn
+	return nil
+}
+
+// send 送出一筆 format 過的 syslog , 寫入失敗時重新連線再試一次
+func (w *syslogWriter) send(b []byte) (err error) {
+	for i := 0; i < 2; i++ {
+		if err = w.connect(); err != nil {
+			return err
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err = w.conn.Write(b); err == nil {
+			return nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	return err
+}
+
+// format 返回 RFC 5424 格式的訊息 : <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+// entry 的欄位放在 STRUCTURED-DATA , tcp 時前面加上訊息長度
+func (w *syslogWriter) format(entry *log.Entry, msg []byte) []byte {
+	b := &bytes.Buffer{}
+	fmt.Fprintf(b, "<%d>1 %s %s %s %d - ", w.facility*8+syslogSeverities[entry.Level],
+		entry.Time.Format(syslogTimeFormat), w.hostname, w.tag, w.pid)
+	writeStructuredData(b, entry.Data)
+	b.WriteByte(' ')
+	b.Write(msg)
+	if w.network == "tcp" {
+		return append([]byte(strconv.Itoa(b.Len())+" "), b.Bytes()...)
+	}
+	return b.Bytes()
+}
+
+// writeStructuredData 將欄位寫成 [wphpfpm@32473 key="value" ...] , 沒有欄位時為 -
+func writeStructuredData(b *bytes.Buffer, data log.Fields) {
+	if len(data) == 0 {
+		b.WriteByte('-')
+		return
+	}
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b.WriteString("[" + syslogSDID)
+	for _, k := range keys {
+		b.WriteByte(' ')
+		b.WriteString(sdName(k))
+		b.WriteString(`="`)
+		var value string
+		switch v := data[k].(type) {
+		case error:
+			value = v.Error()
+		default:
+			value = fmt.Sprint(v)
+		}
+		// PARAM-VALUE 中的 " \ ] 必須 escape
+		for _, r := range value {
+			if r == '"' || r == '\\' || r == ']' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	}
+	b.WriteByte(']')
+}
+
+// sdName 將欄位名稱轉為 SD-NAME , 只能是 32 個字以內的可見 ASCII , 不能包含 = 空白 ] 及 "
+func sdName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 127 || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, name)
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// newTestLogger 建立只經由 sinks 輸出的 logrus.Logger
+func newTestLogger(sinks ...*logSink) *log.Logger {
+	logger := log.New()
+	logger.Out = &bytes.Buffer{}
+	logger.Formatter = nopFormatter{}
+	logger.Level = log.PanicLevel
+	for _, sink := range sinks {
+		logger.AddHook(sink)
+		if sink.level > logger.Level {
+			logger.Level = sink.level
+		}
+	}
+	return logger
+}
+
+func TestLogSinkLevels(t *testing.T) {
+	config := &conf.Conf{}
+	debug, err := newLogSink(&conf.Logger{Type: "stdout", Level: "DEBUG"}, log.ErrorLevel, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errorSink, err := newLogSink(&conf.Logger{Type: "stderr", Format: "json"}, log.ErrorLevel, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	debugOut, errorOut := &bytes.Buffer{}, &bytes.Buffer{}
+	debug.out, errorSink.out = debugOut, errorOut
+
+	logger := newTestLogger(debug, errorSink)
+	logger.Debug("starting")
+	logger.WithField("instance", "web").Error("crashed")
+
+	if s := debugOut.String(); !strings.Contains(s, "[debug]: starting") || !strings.Contains(s, "[error]: crashed instance=web") {
+		t.Errorf("debug sink = %q", s)
+	}
+	if s := errorOut.String(); strings.Contains(s, "starting") || !strings.Contains(s, `"instance":"web"`) {
+		t.Errorf("error sink = %q", s)
+	}
+}
+
+var syslogPattern = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ (\S+) \d+ - (\[.*\]|-) (.*)$`)
+
+func TestSyslogUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	sink, err := newLogSink(&conf.Logger{Type: "syslog", Address: "udp:" + pc.LocalAddr().String(), Facility: "local0", Tag: "php"}, log.InfoLevel, &conf.Conf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := newTestLogger(sink)
+	logger.Debug("ignored")
+	logger.WithFields(log.Fields{"instance": "web", "error": errors.New(`bad "quote"]`)}).Error("php-cgi crashed")
+
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := syslogPattern.FindStringSubmatch(string(buf[:n]))
+	if m == nil {
+		t.Fatalf("not RFC 5424 : %q", buf[:n])
+	}
+	// local0 (16) * 8 + err (3)
+	if m[1] != "131" || m[2] != "php" || m[4] != "php-cgi crashed" {
+		t.Errorf("syslog = %q", buf[:n])
+	}
+	if want := `[wphpfpm@32473 error="bad \"quote\"\]" instance="web"]`; m[3] != want {
+		t.Errorf("STRUCTURED-DATA = %s , want %s", m[3], want)
+	}
+}
+
+// readSyslogTCP 接受一個連線 , 將 octet counting 的訊息送到 lines
+func readSyslogTCP(l net.Listener, lines chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		// octet counting : 長度 空白 訊息
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		lines <- string(msg)
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 2)
+	go readSyslogTCP(l, lines)
+
+	sink, err := newLogSink(&conf.Logger{Type: "syslog", Address: "tcp:" + l.Addr().String(), Format: "logfmt"}, log.InfoLevel, &conf.Conf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := newTestLogger(sink)
+	logger.Info("first")
+	logger.Warn("second")
+
+	for _, want := range []string{"<30>1 ", "<28>1 "} {
+		select {
+		case line := <-lines:
+			m := syslogPattern.FindStringSubmatch(line)
+			if !strings.HasPrefix(line, want) || m == nil || m[3] != "-" || !strings.Contains(m[4], "msg=") {
+				t.Errorf("syslog = %q", line)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("syslog message not received")
+		}
+	}
+}
+
+func TestSyslogDropped(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, syslogQueueSize+1)
+	go readSyslogTCP(l, lines)
+
+	// loop 還沒開始送出 , 佇列滿了之後的訊息被丟棄 , Fire 不會等待
+	sink := &logSink{level: log.InfoLevel, syslog: newSyslogWriter("tcp", l.Addr().String(), "", "")}
+	logger := newTestLogger(sink)
+	start := time.Now()
+	for i := 0; i < syslogQueueSize+3; i++ {
+		logger.Info("message")
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Fire is blocked for %s", d)
+	}
+	if n := atomic.LoadUint64(&sink.syslog.dropped); n != 3 {
+		t.Errorf("dropped = %d , want 3", n)
+	}
+
+	// 下次送出前先告知丟棄的數量 , close 等待佇列送完
+	go sink.syslog.loop()
+	sink.close(5 * time.Second)
+	received := make([]string, 0, syslogQueueSize+1)
+	timeout := time.After(5 * time.Second)
+	for len(received) < syslogQueueSize+1 {
+		select {
+		case line := <-lines:
+			received = append(received, line)
+		case <-timeout:
+			t.Fatalf("received %d messages , want %d", len(received), syslogQueueSize+1)
+		}
+	}
+	if first := received[0]; !strings.Contains(first, `dropped="3"`) || !strings.HasPrefix(first, "<28>1 ") {
+		t.Errorf("first message = %q", first)
+	}
+	if n := atomic.LoadUint64(&sink.syslog.dropped); n != 0 {
+		t.Errorf("dropped = %d after report , want 0", n)
+	}
+	// close 之後的 log 不再送出
+	logger.Info("after close")
+}
+
+func TestSyslogFatal(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	lines := make(chan string, 1)
+	go readSyslogTCP(l, lines)
+
+	sink, err := newLogSink(&conf.Logger{Type: "syslog", Address: "tcp:" + l.Addr().String()}, log.InfoLevel, &conf.Conf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(sinks []*logSink) { logSinks = sinks }(logSinks)
+	logSinks = []*logSink{sink}
+	log.RegisterExitHandler(closeLogSinks)
+
+	// Fatal 結束行程前 , exit handler 等待佇列中的訊息送出
+	logger := newTestLogger(sink)
+	flushed := false
+	logger.ExitFunc = func(int) {
+		select {
+		case <-sink.syslog.done:
+			flushed = true
+		default:
+		}
+	}
+	logger.Fatal("can not listen")
+	if !flushed {
+		t.Error("syslog queue is not flushed before exit")
+	}
+	select {
+	case line := <-lines:
+		if !strings.Contains(line, "can not listen") {
+			t.Errorf("syslog = %q", line)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("syslog message not received")
+	}
+}
@@ -1,21 +1,28 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"wphpfpm/conf"
+	"wphpfpm/fcgi"
+	"wphpfpm/hook"
 	"wphpfpm/phpfpm"
 	"wphpfpm/server"
 
 	"github.com/chai2010/winsvc"
 	log "github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var (
@@ -27,13 +34,40 @@ var (
 	commandStart     *kingpin.CmdClause
 	commandStop      *kingpin.CmdClause
 	commandRun       *kingpin.CmdClause
+	commandUpgrade   *kingpin.CmdClause
 	flagConfigFile   *string
+	flagUpgradePid   *int
 
-	servers []*server.Server
+	servers    []*server.Server
+	managers   []*phpfpm.Manager // 與 config.Instances 的順序相同
+	httpFronts []httpFront
+	eventBus   *hook.Bus    // 設定檔沒有 Hooks 時為 nil
+	stopReason atomic.Value // 服務停止的原因 , 送出 service.stopped 事件時使用
+	logSinks   []*logSink
+
+	// serviceDone 在 startService 停止所有 php-cgi 並送出剩下的事件及 log 後關閉
+	serviceDone = make(chan struct{})
 )
 
+// hookFlushTimeout 服務停止時 , 等待 Hooks 送出剩下事件的時間
+const hookFlushTimeout = 10 * time.Second
+
+// defaultHTTPReadTimeout Instance 沒有設定 ReadTimeout 時 , HTTPListen 讀取整個要求的時間上限
+const defaultHTTPReadTimeout = 60 * time.Second
+
+// logFlushTimeout 服務停止時 , 等待 syslog 送出剩下訊息的時間
+const logFlushTimeout = 5 * time.Second
+
+// httpFront : Instance 的 HTTPListen , 升級時 listener 會交給新的行程
+type httpFront struct {
+	server   *http.Server
+	listener net.Listener
+}
+
 func main() {
-	if !winsvc.IsAnInteractiveSession() {
+	// 以 limits wrapper 啟動時 , 套用 Limits 後 exec php-cgi , 不會返回
+	phpfpm.RunLimitsWrapper()
+	if !interactiveSession() {
 		// run as service
 		flag := kingpin.Flag("conf", "Config file path , required by install or run.")
 		flagConfigFile = flag.Required().String()
@@ -49,9 +83,11 @@ func main() {
 		initCommandFlag()
 		switch kingpin.Parse() {
 		case commandInstall.FullCommand():
+			checkServiceSupported()
 			checkConfigFileExist(*flagConfigFile)
 			installService()
 		case commandUninstall.FullCommand():
+			checkServiceSupported()
 			if err := winsvc.RemoveService(serviceName); err != nil {
 				fmt.Println("Uninstall service: ", err)
 				os.Exit(1)
@@ -61,18 +97,26 @@ func main() {
 			checkConfigFileExist(*flagConfigFile)
 			startService()
 		case commandStart.FullCommand():
+			checkServiceSupported()
 			if err := winsvc.StartService(serviceName); err != nil {
 				fmt.Println("Start service:", err)
 				os.Exit(1)
 			}
 			fmt.Println("Start service: success")
 		case commandStop.FullCommand():
+			checkServiceSupported()
 			if err := winsvc.StopService(serviceName); err != nil {
 				fmt.Println("Stop service:", err)
 				os.Exit(1)
 			}
 			fmt.Println("Stop service: success")
 			return
+		case commandUpgrade.FullCommand():
+			if err := sendUpgrade(*flagUpgradePid); err != nil {
+				fmt.Println("Upgrade:", err)
+				os.Exit(1)
+			}
+			fmt.Println("Upgrade: signal sent")
 		}
 	}
 
@@ -84,6 +128,8 @@ func initCommandFlag() {
 	commandStart = kingpin.Command("start", "Start service.")
 	commandStop = kingpin.Command("stop", "Stop service.")
 	commandRun = kingpin.Command("run", "Run in console mode")
+	commandUpgrade = kingpin.Command("upgrade", "Replace the running wphpfpm with the new executable without refusing connections (not supported on windows).")
+	flagUpgradePid = commandUpgrade.Flag("pid", "Process id of the running wphpfpm.").Required().Int()
 	flag := kingpin.Flag("conf", "Config file path , required by install or run.")
 	if len(os.Args) > 1 && (os.Args[1] == "install" || os.Args[1] == "run") {
 		flagConfigFile = flag.Required().String()
@@ -130,80 +176,335 @@ func startService() {
 
 	fmt.Printf("Start in console mode , press CTRL+C to exit ...\r\n")
 	initLogger(config)
-	err = phpfpm.Start(config)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		// String() 會遮蔽變數展開的值 , Env 及 Headers
+		log.Debugf("Config loaded : %s", config)
+	}
+
+	// 傳入的 fd 必須在啟動 php-cgi 之前取得 , 避免被 php-cgi 繼承
+	prepareUpgradeChild()
+	// systemd socket activation 或升級時傳入的 listener , 依 Name 或 Bind 分配給 Instance
+	inherited, err := server.InheritedListeners()
 	if err != nil {
-		log.Fatalf("Can not start service : %s\n", err.Error())
+		log.Errorf("Can not use inherited listeners : %s", err.Error())
+	}
+
+	if len(config.Hooks) > 0 {
+		if eventBus, err = hook.New(config.Hooks); err != nil {
+			log.Fatalf("Can not start service : %s\n", err.Error())
+		}
+	}
+
+	managers = make([]*phpfpm.Manager, len(config.Instances))
+	byName := make(map[string]*phpfpm.Manager)
+	for i, instance := range config.Instances {
+		if managers[i], err = phpfpm.NewManager(instance); err == nil {
+			managers[i].SetEvents(eventBus)
+			err = managers[i].Start()
+		}
+		if err != nil {
+			stopManagers()
+			log.Fatalf("Can not start service : instance #%d : %s\n", i, err.Error())
+		}
+		if instance.Name != "" {
+			byName[instance.Name] = managers[i]
+		}
+	}
+	handlers := make([]*phpfpm.HTTPHandler, len(config.Instances))
+	for i, instance := range config.Instances {
+		if instance.HTTPListen == "" {
+			continue
+		}
+		if handlers[i], err = phpfpm.NewHTTPHandler(managers[i]); err != nil {
+			stopManagers()
+			log.Fatalf("Can not start service : instance #%d : %s\n", i, err.Error())
+		}
+	}
+	routers := make([]*phpfpm.Router, len(config.Instances))
+	readHead := make([]bool, len(config.Instances))
+	for i, instance := range config.Instances {
+		if len(instance.Routes) > 0 {
+			// 名稱已經在 conf.LoadFile 檢查過
+			routers[i], _ = phpfpm.NewRouter(instance.Routes, byName)
+		}
+		readHead[i] = routers[i] != nil || instance.DeferAcquire || instance.ReadHeaderTimeout > 0
 	}
 
 	var events server.Event
 
 	events.OnConnect = func(c *server.Conn) (action server.Action) {
 
-		p := phpfpm.GetIdleProcess(c.Server().Tag.(int))
+		instanceIndex := c.Server().Tag.(int)
+		m := managers[instanceIndex]
+		var conn net.Conn = c
+		if readHead[instanceIndex] {
+			// 讀完第一個要求的 head 才取得 php-cgi , Routes 依 params 決定由哪個 Instance 處理 , 讀走的資料再轉送給 php-cgi
+			head, params, err := fcgi.ReadHead(c)
+			if err != nil {
+				log.WithFields(log.Fields{"instance": c.Server().Name, "remote_addr": c.RemoteAddr().String()}).WithError(err).Error("Can not read FastCGI params")
+				action = server.Close
+				return
+			}
+			c.HeaderRead()
+			if routers[instanceIndex] != nil {
+				// 整個連線都轉送給同一個 Instance , keep-alive 的 client 之後的要求可能屬於其他 Instance
+				// 清除 FCGI_KEEP_CONN , php-cgi 回應後關閉連線 , client 的下一個要求會以新的連線重新選擇 Instance
+				if fcgi.ClearKeepConn(head) && log.IsLevelEnabled(log.DebugLevel) {
+					log.WithFields(log.Fields{"instance": c.Server().Name, "remote_addr": c.RemoteAddr().String()}).Debug("FCGI_KEEP_CONN is cleared for Routes")
+				}
+				if target := routers[instanceIndex].Route(params); target != nil {
+					m = target
+					if log.IsLevelEnabled(log.DebugLevel) {
+						log.WithFields(log.Fields{"instance": c.Server().Name, "remote_addr": c.RemoteAddr().String(), "route": m.Instance().Name}).Debug("Request routed")
+					}
+				}
+			}
+			conn = phpfpm.NewReplayConn(c, head)
+		}
 
-		if p == nil {
+		var terr error
+		if readHead[instanceIndex] {
+			// 已經收到要求 , 等待 idle 的 php-cgi , 同 listen backlog
+			_, terr = m.DispatchContext(c.Context(), conn) // blocked
+		} else {
+			_, terr = m.Dispatch(conn) // blocked
+		}
+		if terr == phpfpm.ErrNoIdleProcess {
 			if log.IsLevelEnabled(log.ErrorLevel) {
-				log.Error("Can not get php-cgi process")
+				log.WithFields(log.Fields{"instance": c.Server().Name, "remote_addr": c.RemoteAddr().String()}).Error("Can not get php-cgi process")
 			}
 			action = server.Close
-			return
-		}
-		serr, terr := p.Proxy(c) // blocked
-		if log.IsLevelEnabled(log.DebugLevel) {
-			log.Debugf("php-cgi(%s) proxy error , serr : %s , terr : %s", p.ExecWithPippedName(), serr, terr)
+		} else if terr == phpfpm.ErrRateLimited {
+			// Manager 已經記錄過 , 直接關閉連線
+			action = server.Close
 		}
 
-		phpfpm.PutIdleProcess(p)
-
 		return
 	}
 
-	conf := phpfpm.Conf()
-
 	var wg sync.WaitGroup
 
-	wg.Add(len(conf.Instances))
+	servers = make([]*server.Server, 0, len(config.Instances))
 
-	servers = make([]*server.Server, len(conf.Instances))
+	for i := 0; i < len(config.Instances); i++ {
+		instance := config.Instances[i]
+		if instance.Bind == "" {
+			// 只接受 Routes 轉送的 Instance , 不需要 listen
+			continue
+		}
+		listenMode, _ := instance.ListenFileMode() // 已經在 conf.LoadFile 檢查過
+		name := instance.Name
+		if name == "" {
+			// 同 phpfpm.Manager , 沒有 Name 時 log 的 instance 欄位為 Bind
+			name = instance.Bind
+		}
+		s := &server.Server{
+			MaxConnections:          routedMaxConnections(config, i),
+			MaxConnectionsPerClient: instance.MaxConnectionsPerClient,
+			Name:                    name,
+			Events:                  eventBus,
+			BindAddress:             instance.Bind,
+			ListenOwner:             instance.ListenOwner,
+			ListenGroup:             instance.ListenGroup,
+			ListenMode:              listenMode,
+			AllowedClients:          instance.AllowedClients,
+			Tag:                     i,
+
+			ReadHeaderTimeout: time.Duration(instance.ReadHeaderTimeout) * time.Second,
+			IdleTimeout:       time.Duration(instance.IdleTimeout) * time.Second,
+			WriteTimeout:      time.Duration(instance.WriteTimeout) * time.Second,
+		}
+		if instance.TLS != nil {
+			s.TLS = &server.TLSOptions{
+				CertFile:     instance.TLS.CertFile,
+				KeyFile:      instance.TLS.KeyFile,
+				ClientCAFile: instance.TLS.ClientCAFile,
+				MinVersion:   instance.TLS.MinVersion,
+			}
+		}
 
-	for i := 0; i < len(conf.Instances); i++ {
-		instance := conf.Instances[i]
-		servers[i] = &server.Server{MaxConnections: instance.MaxProcesses, BindAddress: instance.Bind, Tag: i}
+		if l := server.MatchListener(&inherited, instance.Name, instance.Bind); l != nil {
+			s.Listener = l
+			s.OwnListener = isUpgradeChild()
+			log.Infof("Server #%d uses inherited listener %s", i, l.Addr().String())
+		}
 
-		log.Infof("Start server #%d on %s", i, servers[i].BindAddress)
+		log.Infof("Start server #%d on %s", i, s.BindAddress)
 
+		servers = append(servers, s)
+		wg.Add(1)
 		go func(s *server.Server) {
-			err := s.Serve(events)
+			err := s.Serve(context.Background(), events)
 			if err != nil {
 				log.Errorf("Service serve error : %s", err.Error())
 			}
 			wg.Done()
-		}(servers[i])
+		}(s)
+	}
+	for i, handler := range handlers {
+		if handler == nil {
+			continue
+		}
+		address := config.Instances[i].HTTPListen
+		// HTTPListen 只依位址比對 , 名稱保留給 Bind 使用
+		l := server.MatchListener(&inherited, "", address)
+		if l != nil {
+			log.Infof("HTTP server #%d uses inherited listener %s", i, l.Addr().String())
+		} else if l, err = net.Listen("tcp", address); err != nil {
+			log.Errorf("HTTP server #%d can not listen on %s : %s", i, address, err.Error())
+			continue
+		}
+
+		instance := config.Instances[i]
+		// AllowedClients , MaxConnectionsPerClient 及 MaxConnections 同樣套用到 HTTPListen
+		// keep-alive 的連線會一直佔用名額 , 所以只有設定 MaxConnections 時才限制連線數量
+		name := instance.Name
+		if name == "" {
+			name = address
+		}
+		guard := &server.Server{
+			MaxConnections:          instance.MaxConnections,
+			MaxConnectionsPerClient: instance.MaxConnectionsPerClient,
+			Name:                    name,
+			Events:                  eventBus,
+			BindAddress:             address,
+			AllowedClients:          instance.AllowedClients,
+		}
+		guarded, err := guard.GuardListener(l)
+		if err != nil {
+			l.Close()
+			log.Errorf("HTTP server #%d can not listen on %s : %s", i, address, err.Error())
+			continue
+		}
+		log.Infof("Start HTTP server #%d on %s", i, address)
+
+		readTimeout := time.Duration(instance.ReadTimeout) * time.Second
+		if readTimeout == 0 {
+			readTimeout = defaultHTTPReadTimeout
+		}
+		hs := &http.Server{
+			Handler:           handler,
+			ReadHeaderTimeout: time.Duration(instance.ReadHeaderTimeout) * time.Second,
+			ReadTimeout:       readTimeout,
+			IdleTimeout:       time.Duration(instance.IdleTimeout) * time.Second,
+		}
+		httpFronts = append(httpFronts, httpFront{server: hs, listener: l})
+		wg.Add(1)
+		// 升級時交出的是原本的 listener , WriteTimeout 及 GuardListener 只包裝 Serve 使用的
+		go func(hs *http.Server, l net.Listener) {
+			if err := hs.Serve(l); err != http.ErrServerClosed {
+				log.Errorf("HTTP serve error : %s", err.Error())
+			}
+			wg.Done()
+		}(hs, server.WriteTimeoutListener(guarded, time.Duration(instance.WriteTimeout)*time.Second))
+	}
+	for _, l := range inherited {
+		log.Warnf("Inherited listener %s (%s) does not match any instance , closed", l.Listener.Addr().String(), l.Name)
+		l.Listener.Close()
 	}
 	log.Info("Service running ...")
+	notifyReady()
+	watchUpgrade()
 
-	// 這段處理 CTRL + C
+	// 這段處理 CTRL + C 及 SIGTERM
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		for sig := range c {
 			log.Infof("Service got signal: %s", sig.String())
+			stopReason.Store("got signal " + sig.String())
 			stopService()
 			return
 		}
 	}()
 
 	wg.Wait()
-	phpfpm.Stop()
+	// 等待處理中的連線結束 , 才停止 php-cgi (Shutdown 可以重複呼叫)
+	for i := 0; i < len(servers); i++ {
+		servers[i].Shutdown(context.Background())
+	}
+	for _, f := range httpFronts {
+		f.server.Shutdown(context.Background())
+	}
+	stopManagers()
 	log.Info("Service Stopped.")
+	flushEvents()
+	closeLogSinks()
+	close(serviceDone)
+}
+
+// flushEvents 送出 service.stopped 事件 , 並等待 Hooks 送出剩下的事件
+func flushEvents() {
+	if eventBus == nil {
+		return
+	}
+	reason, _ := stopReason.Load().(string)
+	if reason == "" {
+		reason = "stopped"
+	}
+	eventBus.Publish(hook.Event{Type: hook.ServiceStopped, Source: serviceName, PID: os.Getpid(), Message: "Service " + reason})
+	ctx, cancel := context.WithTimeout(context.Background(), hookFlushTimeout)
+	defer cancel()
+	if err := eventBus.Close(ctx); err != nil {
+		log.Warnf("Hooks can not send all events before exit : %s", err.Error())
+	}
+}
+
+// closeLogSinks 等待 syslog 送出剩下的訊息 , 最多等待 logFlushTimeout
+// 也註冊為 logrus 的 exit handler , log.Fatalf 結束行程前送出啟動失敗的原因
+func closeLogSinks() {
+	for _, sink := range logSinks {
+		sink.close(logFlushTimeout)
+	}
+}
+
+// deferredConnectionsFactor DeferAcquire 時 , 預設的連線上限是 php-cgi 數量的幾倍
+const deferredConnectionsFactor = 4
+
+// routedMaxConnections Instance 的連線上限 , 有 Routes 時加上轉送目標的 php-cgi 數量
+// 先讀取 head 才取得 php-cgi 時 , 預設為 deferredConnectionsFactor 倍
+func routedMaxConnections(config *conf.Conf, instanceIndex int) int {
+	instance := config.Instances[instanceIndex]
+	if instance.MaxConnections > 0 {
+		return instance.MaxConnections
+	}
+	max := instance.MaxProcesses
+	targets := map[string]bool{}
+	for _, route := range config.Instances[instanceIndex].Routes {
+		target := config.InstanceIndex(route.Instance)
+		if target != instanceIndex && !targets[route.Instance] {
+			targets[route.Instance] = true
+			max += config.Instances[target].MaxProcesses
+		}
+	}
+	if instance.DeferAcquire || instance.ReadHeaderTimeout > 0 {
+		max *= deferredConnectionsFactor
+	}
+	return max
+}
+
+// stopManagers 停止所有已經建立的 php-cgi pool
+func stopManagers() {
+	for _, m := range managers {
+		if m != nil {
+			m.Stop()
+		}
+	}
 }
 
 // 停止服務
+// 等待 startService 結束 (處理中的連線結束 , php-cgi 已停止) 才返回
+// windows service 在 stopService 返回後就會結束行程 , 提早返回會留下 php-cgi
 func stopService() {
 
+	// 處理中的連線由 startService 等待
 	for i := 0; i < len(servers); i++ {
-		servers[i].Shutdown()
+		go servers[i].Shutdown(context.Background())
+	}
+	for _, f := range httpFronts {
+		go f.server.Shutdown(context.Background())
 	}
+	<-serviceDone
 
 }
 
@@ -217,36 +518,6 @@ func checkConfigFileExist(filepath string) {
 
 func initLogger(config *conf.Conf) {
 
-	formatter := &MyTextFormatter{timeFormat: "2006-01-02 15:04:05 -0700"}
-	log.SetFormatter(formatter)
-
-	// Set logger
-	if len(config.Logger.Filename) > 0 {
-
-		logDir := filepath.Dir(config.Logger.Filename)
-		exeDir, err := filepath.Abs(filepath.Dir(os.Args[0])) // 執行檔的路徑
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		if logDir == "." || logDir == "" {
-			// 如果 Filename 沒指定路徑，修正為 exe 的路徑
-			config.Logger.Filename = exeDir + "\\" + config.Logger.Filename
-		}
-
-		logger := &lumberjack.Logger{
-			Filename:   config.Logger.Filename,
-			MaxSize:    config.Logger.MaxSize,
-			MaxBackups: config.Logger.MaxBackups,
-			MaxAge:     config.Logger.MaxAge,
-			Compress:   config.Logger.Compress,
-		}
-		log.SetOutput(logger)
-		fmt.Printf("Logger ouput set to file %s .\n", config.Logger.Filename)
-	} else {
-		fmt.Printf("Logger ouput set to console.\n")
-	}
-
 	if config.LogLevel == "" {
 		config.LogLevel = "ERROR"
 	}
@@ -255,7 +526,32 @@ func initLogger(config *conf.Conf) {
 	if err != nil {
 		log.Fatalf("LogLevel %s can not parse.", config.LogLevel)
 	}
-	log.SetLevel(logLevel)
+
+	// Set logger , 每個 Logger 是一個 hook , logrus 本身不再輸出
+	if len(config.Logger) == 0 {
+		config.Logger = conf.Loggers{{Type: "stderr"}}
+	}
+	hooks := make(log.LevelHooks)
+	maxLevel := log.PanicLevel
+	for i := range config.Logger {
+		sink, err := newLogSink(&config.Logger[i], logLevel, config)
+		if err != nil {
+			log.Fatalf("Logger #%d %s", i, err.Error())
+		}
+		hooks.Add(sink)
+		logSinks = append(logSinks, sink)
+		if sink.level > maxLevel {
+			maxLevel = sink.level
+		}
+		fmt.Printf("Logger ouput set to %s , level %s .\n", sink.name, strings.ToUpper(sink.level.String()))
+	}
+	log.SetFormatter(nopFormatter{})
+	log.SetOutput(ioutil.Discard)
+	log.StandardLogger().ReplaceHooks(hooks)
+	log.RegisterExitHandler(closeLogSinks)
+
+	// logrus 的等級為所有 Logger 中最詳細的 , 各個 Logger 再依自己的 Level 過濾
+	log.SetLevel(maxLevel)
 	log.Infof("Set LogLevel to %s.", strings.ToUpper(logLevel.String()))
 
 	// Repair config
@@ -273,25 +569,3 @@ func initLogger(config *conf.Conf) {
 		}
 	}
 }
-
-// MyTextFormatter logrus custom formatter
-type MyTextFormatter struct {
-	timeFormat string
-}
-
-// Format logrus custom format
-func (f *MyTextFormatter) Format(entry *log.Entry) ([]byte, error) {
-	var b *bytes.Buffer
-	if entry.Buffer != nil {
-		b = entry.Buffer
-	} else {
-		b = &bytes.Buffer{}
-	}
-	b.WriteString(entry.Time.Format(f.timeFormat))
-	b.WriteString(" [")
-	b.WriteString(entry.Level.String())
-	b.WriteString("]: ")
-	b.WriteString(entry.Message)
-	b.WriteByte('\n')
-	return b.Bytes(), nil
-}
@@ -0,0 +1,196 @@
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"wphpfpm/fcgi"
+	"wphpfpm/hook"
+)
+
+// Response : php-cgi 處理一個 FastCGI 要求的結果
+type Response struct {
+	Status    int         // Status header 的狀態碼 , 沒有 Status 時為 200
+	Header    http.Header // php-cgi 輸出的 header , 不包含 Status
+	Body      []byte
+	Stderr    []byte // FCGI_STDERR 的內容 , 如 PHP 的錯誤訊息
+	AppStatus uint32 // END_REQUEST 的 appStatus , 即 php-cgi 的 exit code
+}
+
+// workerConn : Dial 返回的連線 , Close 時將 php-cgi 放回 idle
+type workerConn struct {
+	net.Conn
+	m    *Manager
+	p    *Process
+	once sync.Once
+	err  error
+}
+
+// Close 關閉與 php-cgi 的連線並 Release , 重複呼叫只會執行一次
+func (c *workerConn) Close() error {
+	c.once.Do(func() {
+		c.err = c.m.Release(c.p)
+	})
+	return c.err
+}
+
+// Dial 取得一個 idle 的 php-cgi 並返回與它的連線 , 關閉連線時 php-cgi 會自動放回 idle
+// 沒有 idle 的 php-cgi 時會等待 , 直到有 php-cgi 放回 idle 或 ctx 結束
+// 連線上直接讀寫 FastCGI records
+// 超過 RateLimit 時返回 ErrRateLimited , queue 模式則等待
+func (m *Manager) Dial(ctx context.Context) (net.Conn, error) {
+	p, err := m.connect(ctx, func() (*Process, error) {
+		return m.acquireContext(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &workerConn{Conn: p.pipe, m: m, p: p}, nil
+}
+
+// acquireContext 同 Acquire , 沒有 idle 的 php-cgi 時等待到 ctx 結束
+func (m *Manager) acquireContext(ctx context.Context) (*Process, error) {
+	for waited := false; ; waited = true {
+		if p := m.Acquire(); p != nil {
+			return p, nil
+		}
+		m.mutex.Lock()
+		if !m.running {
+			m.mutex.Unlock()
+			return nil, ErrNotRunning
+		}
+		// Acquire 之後才放回 idle 的 , idleCh 已經被關閉 , 不會漏掉
+		idleCh := m.idleCh
+		if m.idle.Len() > 0 {
+			m.mutex.Unlock()
+			continue
+		}
+		m.mutex.Unlock()
+		if !waited {
+			m.publish(hook.PoolExhausted, nil, "all %d php-cgi are busy , request is waiting", m.instance.MaxProcesses)
+		}
+		select {
+		case <-idleCh:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Do 以一個 idle 的 php-cgi 執行 FastCGI 要求 , 並返回完整的回應
+// params 至少需要 SCRIPT_FILENAME , stdin 不是 nil 且沒有 CONTENT_LENGTH 時會自動計算
+// ctx 結束時會中斷與 php-cgi 的連線並返回 ctx.Err()
+func (m *Manager) Do(ctx context.Context, params map[string]string, stdin io.Reader) (*Response, error) {
+	var body []byte
+	if stdin != nil {
+		var err error
+		if body, err = ioutil.ReadAll(stdin); err != nil {
+			return nil, err
+		}
+	}
+	values := make(map[string]string, len(params)+1)
+	for k, v := range params {
+		values[k] = v
+	}
+	if _, ok := values["CONTENT_LENGTH"]; !ok && stdin != nil {
+		values["CONTENT_LENGTH"] = strconv.Itoa(len(body))
+	}
+
+	conn, err := m.Dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	defer watchContext(ctx, conn)()
+
+	stdout, stderr, appStatus, err := roundTrip(conn, values, body, -1)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp, err := parseResponse(stdout)
+	if err != nil {
+		return nil, err
+	}
+	resp.Stderr = stderr
+	resp.AppStatus = appStatus
+	return resp, nil
+}
+
+// roundTrip 在 conn 上送出 requestId 1 的 FCGI_RESPONDER 要求 , 讀取到 END_REQUEST 為止
+// maxStdout 大於等於 0 時 , 只保留 stdout 開頭的 maxStdout bytes
+func roundTrip(conn io.ReadWriter, params map[string]string, stdin []byte, maxStdout int) (stdout []byte, stderr []byte, appStatus uint32, err error) {
+	var req bytes.Buffer
+	// role = FCGI_RESPONDER , flags = 0 (處理完後 php-cgi 關閉連線)
+	fcgi.WriteRecord(&req, fcgi.TypeBeginRequest, 1, []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	fcgi.WriteStream(&req, fcgi.TypeParams, 1, fcgi.EncodeParams(params))
+	fcgi.WriteStream(&req, fcgi.TypeStdin, 1, stdin)
+	if _, err = conn.Write(req.Bytes()); err != nil {
+		return
+	}
+
+	var out, errOut bytes.Buffer
+	var rec fcgi.Record
+	for {
+		if err = fcgi.ReadRecord(conn, &rec); err != nil {
+			return
+		}
+		switch rec.Type {
+		case fcgi.TypeStdout:
+			if maxStdout < 0 || out.Len() < maxStdout {
+				out.Write(rec.Content)
+			}
+		case fcgi.TypeStderr:
+			errOut.Write(rec.Content)
+		case fcgi.TypeEndRequest:
+			if len(rec.Content) < 8 {
+				err = errors.New("invalid END_REQUEST")
+				return
+			}
+			if rec.Content[4] != 0 {
+				err = fmt.Errorf("protocol status %d", rec.Content[4])
+				return
+			}
+			appStatus = uint32(rec.Content[0])<<24 | uint32(rec.Content[1])<<16 | uint32(rec.Content[2])<<8 | uint32(rec.Content[3])
+			return out.Bytes(), errOut.Bytes(), appStatus, nil
+		}
+	}
+}
+
+// parseResponse 將 php-cgi 的 stdout 分成 header 及 body
+func parseResponse(stdout []byte) (*Response, error) {
+	r := bufio.NewReader(bytes.NewReader(stdout))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid response header , %s", err.Error())
+	}
+	resp := &Response{Status: http.StatusOK, Header: http.Header(header)}
+	if resp.Header == nil {
+		resp.Header = http.Header{}
+	}
+	if status := resp.Header.Get("Status"); status != "" {
+		code, err := strconv.Atoi(strings.Fields(status)[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid Status %s", status)
+		}
+		resp.Status = code
+		resp.Header.Del("Status")
+	}
+	resp.Body, _ = ioutil.ReadAll(r)
+	return resp, nil
+}
@@ -0,0 +1,111 @@
+package phpfpm
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// closeWatchBufferSize 等待 php-cgi 期間 , 最多暫存多少 client 送來的資料 , 超過時暫停讀取
+const closeWatchBufferSize = 64 * 1024
+
+// closeWatcher 等待 token 或 idle 的 php-cgi 時 , 在背景讀取 client 的連線
+// 讀到錯誤 (如 client 關閉連線 , IdleTimeout) 時取消 ctx , 讀到的資料暫存起來 , 之後由 Read 讀出
+// 不需要等待時不會啟動 , 直接使用原本的連線
+type closeWatcher struct {
+	net.Conn
+	cancel  context.CancelFunc
+	started bool // 只在 dispatch 的 goroutine 中讀寫
+
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	buf     []byte
+	err     error
+	stopped bool // dispatch 已經結束 , loop 不再讀取
+}
+
+// closeContext : Done 第一次被呼叫 , 即 waitRate 或 acquireContext 準備等待時 , 才開始監看連線
+type closeContext struct {
+	context.Context
+	once    sync.Once
+	watcher *closeWatcher
+}
+
+func (c *closeContext) Done() <-chan struct{} {
+	c.once.Do(c.watcher.start)
+	return c.Context.Done()
+}
+
+// watchClose 返回 client 關閉連線時會被取消的 ctx , 取得 php-cgi 後以 watcher.conn() 代替原本的連線
+func watchClose(ctx context.Context, conn net.Conn) (context.Context, *closeWatcher, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &closeWatcher{Conn: conn, cancel: cancel}
+	w.cond = sync.NewCond(&w.mutex)
+	return &closeContext{Context: ctx, watcher: w}, w, cancel
+}
+
+// start 開始在背景讀取連線
+func (w *closeWatcher) start() {
+	w.started = true
+	go w.loop()
+}
+
+func (w *closeWatcher) loop() {
+	b := make([]byte, 4096)
+	for {
+		w.mutex.Lock()
+		for len(w.buf) >= closeWatchBufferSize && !w.stopped {
+			w.cond.Wait()
+		}
+		stopped := w.stopped
+		w.mutex.Unlock()
+		if stopped {
+			return
+		}
+
+		n, err := w.Conn.Read(b)
+		w.mutex.Lock()
+		w.buf = append(w.buf, b[:n]...)
+		if err != nil {
+			w.err = err
+			w.cancel()
+		}
+		w.cond.Broadcast()
+		w.mutex.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Read 先讀出暫存的資料 , 沒有資料時等待 loop 讀到新的資料或錯誤
+func (w *closeWatcher) Read(b []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for len(w.buf) == 0 && w.err == nil {
+		w.cond.Wait()
+	}
+	if len(w.buf) > 0 {
+		n := copy(b, w.buf)
+		w.buf = w.buf[n:]
+		w.cond.Broadcast()
+		return n, nil
+	}
+	return 0, w.err
+}
+
+// stop dispatch 結束時呼叫 , 暫存已滿而等待中的 loop 會結束 , 讀取中的 loop 在連線關閉後結束
+func (w *closeWatcher) stop() {
+	w.mutex.Lock()
+	w.stopped = true
+	w.cond.Broadcast()
+	w.mutex.Unlock()
+}
+
+// conn 返回取得 php-cgi 之後使用的連線 , 沒有開始監看時就是原本的連線
+func (w *closeWatcher) conn() net.Conn {
+	if w.started {
+		return w
+	}
+	return w.Conn
+}
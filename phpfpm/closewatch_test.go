@@ -0,0 +1,69 @@
+package phpfpm
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWatchClose(t *testing.T) {
+	client, server := net.Pipe()
+	ctx, watcher, cancel := watchClose(context.Background(), server)
+	defer cancel()
+	defer watcher.stop()
+
+	// 沒有等待時不監看 , 直接使用原本的連線
+	if watcher.conn() != server {
+		t.Fatal("watcher should not wrap the connection before waiting")
+	}
+
+	// 等待期間送來的資料會暫存 , 之後由 watcher.conn() 讀出
+	done := ctx.Done()
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ctx should be cancelled when client closes the connection")
+	}
+	b, err := ioutil.ReadAll(watcher.conn())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "request" {
+		t.Errorf("buffered data should be replayed , got %q", b)
+	}
+}
+
+func TestWatchCloseStop(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	ctx, watcher, cancel := watchClose(context.Background(), server)
+	defer cancel()
+	ctx.Done()
+
+	// 暫存已滿時 loop 等待 , stop 後結束
+	go client.Write(make([]byte, closeWatchBufferSize))
+	deadline := time.Now().Add(time.Second)
+	for {
+		watcher.mutex.Lock()
+		full := len(watcher.buf) >= closeWatchBufferSize
+		watcher.mutex.Unlock()
+		if full {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("watcher should buffer data from client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	watcher.stop()
+	client.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("stopped watcher should not read from client")
+	}
+}
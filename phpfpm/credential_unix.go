@@ -0,0 +1,131 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+	"wphpfpm/conf"
+)
+
+// credential 是 php-cgi 執行時的 uid , gid 及附加群組
+type credential = syscall.Credential
+
+// newCredential 依據 Instance 的 User , Group 及 Groups 建立 credential , 沒有設定 User 時返回 nil
+// 同時檢查 wphpfpm 是否有權限切換使用者
+func newCredential(instance conf.Instance) (*credential, error) {
+	if instance.User == "" {
+		if instance.Group != "" || len(instance.Groups) > 0 {
+			return nil, fmt.Errorf("Group and Groups require User")
+		}
+		return nil, nil
+	}
+
+	u, err := lookupUser(instance.User)
+	if err != nil {
+		return nil, err
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+
+	if instance.Group != "" {
+		if gid, err = lookupGroup(instance.Group); err != nil {
+			return nil, err
+		}
+	}
+
+	// 沒有指定 Groups 時 , 使用該使用者本身所屬的群組
+	var groups []uint32
+	if len(instance.Groups) > 0 {
+		for _, name := range instance.Groups {
+			g, err := lookupGroup(name)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, uint32(g))
+		}
+	} else {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			g, err := strconv.Atoi(id)
+			if err == nil {
+				groups = append(groups, uint32(g))
+			}
+		}
+	}
+
+	cred := &credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	currentGroups, err := os.Getgroups()
+	if err != nil {
+		return nil, err
+	}
+	return checkCredential(cred, instance.User, os.Geteuid(), os.Getegid(), currentGroups)
+}
+
+// checkCredential 檢查 wphpfpm (euid , egid 及 groups) 是否可以切換為 cred
+// 與目前的身分完全相同時不需要切換 , 返回 nil , 否則必須是 root , 才不會到 php-cgi 啟動時才失敗
+func checkCredential(cred *credential, name string, euid int, egid int, groups []int) (*credential, error) {
+	if euid == 0 {
+		return cred, nil
+	}
+	if int(cred.Uid) == euid && int(cred.Gid) == egid && sameGroups(cred.Groups, groups) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("wphpfpm must run as root to start php-cgi as user %s", name)
+}
+
+// sameGroups 兩組群組是否相同 , 不分順序
+func sameGroups(a []uint32, b []int) bool {
+	set := make(map[int]bool, len(b))
+	for _, g := range b {
+		set[g] = true
+	}
+	for _, g := range a {
+		if !set[int(g)] {
+			return false
+		}
+		delete(set, int(g))
+	}
+	return len(set) == 0
+}
+
+// lookupUser 以名稱或 uid 查詢使用者
+func lookupUser(name string) (*user.User, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, fmt.Errorf("unknown user %s", name)
+		}
+	}
+	return u, nil
+}
+
+// lookupGroup 以名稱或 gid 查詢群組
+func lookupGroup(name string) (int, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		if g, err = user.LookupGroupId(name); err != nil {
+			return 0, fmt.Errorf("unknown group %s", name)
+		}
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// setCredential 設定 php-cgi 以 cred 的身分執行
+func setCredential(cmd *exec.Cmd, cred *credential) {
+	if cred == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+}
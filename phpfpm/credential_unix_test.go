@@ -0,0 +1,63 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+	"wphpfpm/conf"
+)
+
+func TestNewCredential(t *testing.T) {
+	if cred, err := newCredential(conf.Instance{}); cred != nil || err != nil {
+		t.Errorf("no User = %v , %v", cred, err)
+	}
+	if _, err := newCredential(conf.Instance{Group: "nogroup"}); err == nil {
+		t.Error("expected error for Group without User")
+	}
+	if _, err := newCredential(conf.Instance{User: "wphpfpm-no-such-user"}); err == nil {
+		t.Error("expected error for unknown user")
+	}
+
+	// 以 wphpfpm 本身的使用者執行 , root 時切換身分 , 其他使用者不需要切換
+	u, err := user.Current()
+	if err != nil {
+		t.Skip(err)
+	}
+	cred, err := newCredential(conf.Instance{User: u.Username})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.Geteuid() == 0 {
+		if cred == nil || strconv.Itoa(int(cred.Uid)) != u.Uid {
+			t.Errorf("root should switch to %s , got %+v", u.Username, cred)
+		}
+	} else if cred != nil && (int(cred.Gid) != os.Getegid() || cred.Uid != uint32(os.Geteuid())) {
+		t.Errorf("unexpected credential %+v", cred)
+	}
+}
+
+func TestCheckCredential(t *testing.T) {
+	cred := &credential{Uid: 1000, Gid: 1000, Groups: []uint32{1000, 27}}
+	tests := []struct {
+		euid, egid int
+		groups     []int
+		switched   bool
+		fails      bool
+	}{
+		{0, 0, []int{0}, true, false},
+		{1000, 1000, []int{27, 1000}, false, false},
+		{1000, 1000, []int{1000}, false, true},
+		{1000, 100, []int{1000, 27}, false, true},
+		{1001, 1000, []int{1000, 27}, false, true},
+	}
+	for _, test := range tests {
+		got, err := checkCredential(cred, "www", test.euid, test.egid, test.groups)
+		if (err != nil) != test.fails || (got != nil) != test.switched {
+			t.Errorf("checkCredential as %d:%d %v = %+v , %v", test.euid, test.egid, test.groups, got, err)
+		}
+	}
+}
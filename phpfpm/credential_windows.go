@@ -0,0 +1,22 @@
+package phpfpm
+
+import (
+	"errors"
+	"os/exec"
+	"wphpfpm/conf"
+)
+
+// credential windows 不支援切換使用者
+type credential struct{}
+
+// newCredential windows 不支援 User , Group 及 Groups
+func newCredential(instance conf.Instance) (*credential, error) {
+	if instance.User != "" || instance.Group != "" || len(instance.Groups) > 0 {
+		return nil, errors.New("User , Group and Groups are not supported on windows")
+	}
+	return nil, nil
+}
+
+// setCredential windows 不支援切換使用者
+func setCredential(cmd *exec.Cmd, cred *credential) {
+}
@@ -0,0 +1,100 @@
+package phpfpm
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"wphpfpm/hook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultConnectRetries Instance 沒有設定 ConnectRetries 時的預設值
+const defaultConnectRetries = 2
+
+// ErrNoIdleProcess 沒有 idle 的 php-cgi 可以使用
+var ErrNoIdleProcess = errors.New("no idle php-cgi process")
+
+// Dispatch 取得 idle 的 php-cgi 處理 conn , 處理完畢後放回 idle
+// 無法連線 php-cgi 時還沒有送出任何資料 , 該 php-cgi 會被重新啟動 , 並換另一個 idle 的 php-cgi 重試
+// 超過 RateLimit 時返回 ErrRateLimited , queue 模式則等待 , client 關閉連線時停止等待
+func (m *Manager) Dispatch(conn net.Conn) (serr error, terr error) {
+	return m.dispatch(context.Background(), conn, func(context.Context) (*Process, error) {
+		return m.tryAcquire()
+	})
+}
+
+// DispatchContext 同 Dispatch , 但沒有 idle 的 php-cgi 時等待 , 直到有 php-cgi 放回 idle , client 關閉連線或 ctx 結束
+func (m *Manager) DispatchContext(ctx context.Context, conn net.Conn) (serr error, terr error) {
+	return m.dispatch(ctx, conn, m.acquireContext)
+}
+
+// dispatch 以 acquire 取得 php-cgi 處理 conn
+// acquire 必須以 dispatch 傳入的 ctx 等待
+func (m *Manager) dispatch(ctx context.Context, conn net.Conn, acquire func(ctx context.Context) (*Process, error)) (serr error, terr error) {
+	// 需要等待時才開始監看 client 是否關閉連線 , 不需要等待時直接轉送
+	ctx, watcher, cancel := watchClose(ctx, conn)
+	defer cancel()
+	defer watcher.stop()
+	p, err := m.connect(ctx, func() (*Process, error) {
+		return acquire(ctx)
+	})
+	if err != nil {
+		return nil, err
+	}
+	serr, terr = p.proxy(watcher.conn()) // blocked
+	if log.IsLevelEnabled(log.DebugLevel) {
+		p.requestLogger().WithFields(log.Fields{"serr": serr, "terr": terr}).Debug("php-cgi proxy finished")
+	}
+	m.Release(p)
+	return
+}
+
+// tryAcquire 同 Acquire , 沒有 idle 的 php-cgi 時返回 ErrNoIdleProcess
+func (m *Manager) tryAcquire() (*Process, error) {
+	if p := m.Acquire(); p != nil {
+		return p, nil
+	}
+	m.publish(hook.PoolExhausted, nil, "all %d php-cgi are busy , request rejected", m.instance.MaxProcesses)
+	return nil, ErrNoIdleProcess
+}
+
+// connect 依 RateLimit 取得 token 後 , 以 acquire 取得 php-cgi 並連線 , 成功時 p.pipe 已經連線 , 使用完畢後必須呼叫 Release
+// 無法連線的 php-cgi 會被重新啟動 , 並換另一個 php-cgi 重試 , 超過重試次數時返回 *ConnectError
+func (m *Manager) connect(ctx context.Context, acquire func() (*Process, error)) (*Process, error) {
+	if err := m.waitRate(ctx); err != nil {
+		return nil, err
+	}
+	retries := m.connectRetryLimit()
+	for attempt := 0; ; attempt++ {
+		p, err := acquire()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.connectPipe(); err == nil {
+			return p, nil
+		}
+		p.connectFailed = true
+		if attempt >= retries {
+			m.Release(p)
+			return nil, &ConnectError{Err: err}
+		}
+		// 重新啟動需要時間 , 不等待 , 直接換下一個 php-cgi
+		go m.Release(p)
+		count := atomic.AddUint64(&m.connectRetries, 1)
+		p.requestLogger().WithField("retries", count).Warn("php-cgi can not be connected , retry on another php-cgi")
+	}
+}
+
+// connectRetryLimit 最多重試幾次 , ConnectRetries 為負數時不重試 , 0 時為預設值
+func (m *Manager) connectRetryLimit() int {
+	retries := m.instance.ConnectRetries
+	if retries == 0 {
+		return defaultConnectRetries
+	}
+	if retries < 0 {
+		return 0
+	}
+	return retries
+}
@@ -0,0 +1,142 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+)
+
+// refuseConnections 移除 php-cgi 的 unix socket , 之後連線這個 php-cgi 都會失敗
+func refuseConnections(t *testing.T, p *Process) {
+	if err := os.Remove(p.pippedName); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitIdle 等待 m 的 idle 數量為 n
+func waitIdle(t *testing.T, m *Manager, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for stats := m.Stats(); stats.Idle != n; stats = m.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d idle php-cgi %+v", n, stats)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectRetry(t *testing.T) {
+	// fifo 先使用 processes[0]
+	m := newTestManager(t, conf.Instance{MaxProcesses: 2, Strategy: StrategyFIFO})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	broken, good := m.processes[0], m.processes[1]
+	refuseConnections(t, broken)
+
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php"}
+	resp, err := m.Do(context.Background(), params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid := fmt.Sprintf("pid=%d ", pidOf(m, good)); !strings.Contains(string(resp.Body), pid) {
+		t.Errorf("request should be retried on the other php-cgi (%s) : %q", pid, resp.Body)
+	}
+	if stats := m.Stats(); stats.ConnectRetries != 1 {
+		t.Errorf("expected 1 connect retry %+v", stats)
+	}
+
+	// 無法連線的 php-cgi 被重新啟動後放回 idle
+	waitIdle(t, m, 2)
+	if stats := m.Stats(); stats.Restarts != 1 {
+		t.Errorf("php-cgi that can not be connected should be restarted %+v", stats)
+	}
+	if _, err := m.Do(context.Background(), params, nil); err != nil {
+		t.Errorf("restarted php-cgi : %v", err)
+	}
+}
+
+func TestConnectRetryExhausted(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 2, ConnectRetries: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for _, p := range m.processes {
+		refuseConnections(t, p)
+	}
+
+	// 重試一次後仍然無法連線 , 返回 *ConnectError
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php"}
+	_, err := m.Do(context.Background(), params, nil)
+	if _, ok := err.(*ConnectError); !ok {
+		t.Fatalf("expected *ConnectError , got %v", err)
+	}
+	if stats := m.Stats(); stats.ConnectRetries != 1 {
+		t.Errorf("expected 1 connect retry %+v", stats)
+	}
+	waitIdle(t, m, 2)
+	if stats := m.Stats(); stats.Restarts != 2 {
+		t.Errorf("both php-cgi should be restarted %+v", stats)
+	}
+}
+
+func TestConnectNoRetry(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 2, ConnectRetries: -1, Strategy: StrategyFIFO})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	refuseConnections(t, m.processes[0])
+
+	// ConnectRetries 為負數時不重試
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php"}
+	if _, err := m.Do(context.Background(), params, nil); err == nil {
+		t.Fatal("expected connect error without retry")
+	}
+	if stats := m.Stats(); stats.ConnectRetries != 0 {
+		t.Errorf("expected no connect retry %+v", stats)
+	}
+	waitIdle(t, m, 2)
+}
+
+func TestDispatchQueueClientClose(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, RateLimit: 0.1, RateBurst: 1, RateLimitMode: "queue"})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php"}
+	if _, err := m.Do(context.Background(), params, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 沒有 token , Dispatch 等待中 client 關閉連線 , 不需要等到下一個 token
+	client, server := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		_, terr := m.Dispatch(server)
+		done <- terr
+	}()
+	time.Sleep(50 * time.Millisecond)
+	client.Close()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("expected context.Canceled , got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("queued Dispatch should return when client closes the connection")
+	}
+	if stats := m.Stats(); stats.RateQueued != 1 {
+		t.Errorf("expected 1 queued request %+v", stats)
+	}
+}
@@ -0,0 +1,458 @@
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"wphpfpm/fcgi"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultIndexFiles Instance 沒有設定 IndexFiles 時的預設值
+var defaultIndexFiles = []string{"index.php", "index.html"}
+
+// defaultMaxRequestBody Instance 沒有設定 MaxRequestBody 時的預設值 (MB)
+const defaultMaxRequestBody = 8
+
+// bodyMemoryLimit 要求 body 暫存在記憶體的上限 , 超過的部分暫存至檔案
+var bodyMemoryLimit int64 = 1024 * 1024
+
+// errBodyTooLarge 要求 body 超過 MaxRequestBody
+var errBodyTooLarge = errors.New("request body too large")
+
+// HTTPHandler : 將 HTTP 要求轉為 FastCGI 要求 , 直接交給 Manager 的 php-cgi 處理
+// .php 以外的檔案以靜態檔案提供 , 以 . 開頭的檔案或目錄 (如 .git , .env) 一律返回 404
+type HTTPHandler struct {
+	m               *Manager
+	documentRoot    string
+	indexFiles      []string
+	frontController string
+	maxBody         int64 // 要求 body 的上限 (bytes)
+}
+
+// NewHTTPHandler 依據 Manager 的 Instance 設定 (DocumentRoot , IndexFiles , FrontController) 建立 HTTPHandler
+func NewHTTPHandler(m *Manager) (*HTTPHandler, error) {
+	instance := m.instance
+	root, err := filepath.Abs(instance.DocumentRoot)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("DocumentRoot %s is not a directory", root)
+	}
+	h := &HTTPHandler{
+		m:               m,
+		documentRoot:    root,
+		indexFiles:      instance.IndexFiles,
+		frontController: instance.FrontController,
+		maxBody:         int64(instance.MaxRequestBody) * 1024 * 1024,
+	}
+	if h.maxBody == 0 {
+		h.maxBody = defaultMaxRequestBody * 1024 * 1024
+	}
+	if len(h.indexFiles) == 0 {
+		h.indexFiles = defaultIndexFiles
+	}
+	if h.frontController != "" {
+		h.frontController = path.Clean("/" + filepath.ToSlash(h.frontController))
+	}
+	return h, nil
+}
+
+// target : URL 路徑對應到的檔案
+type target struct {
+	scriptName string // PHP 的 SCRIPT_NAME , 靜態檔案時為空
+	filename   string // 實際找到的檔案 , PHP 時即為 SCRIPT_FILENAME
+	pathInfo   string
+	redirect   string // 目錄缺少結尾的 / 時 , 轉址的目標
+}
+
+// ServeHTTP 依序尋找 PATH_INFO 前的 .php , 檔案 , 目錄的 IndexFiles , 最後是 FrontController
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t, ok := h.resolve(r.URL.Path)
+	switch {
+	case !ok:
+		http.NotFound(w, r)
+	case t.redirect != "":
+		if r.URL.RawQuery != "" {
+			t.redirect += "?" + r.URL.RawQuery
+		}
+		http.Redirect(w, r, t.redirect, http.StatusMovedPermanently)
+	case t.scriptName != "":
+		h.servePHP(w, r, t)
+	default:
+		h.serveFile(w, r, t.filename)
+	}
+}
+
+// resolve 將 URL 路徑對應到 DocumentRoot 中的檔案 , 找不到或路徑不安全時 ok 為 false
+func (h *HTTPHandler) resolve(urlPath string) (t target, ok bool) {
+	upath := path.Clean("/" + urlPath)
+	if unsafePath(upath) {
+		return t, false
+	}
+
+	// /index.php/foo/bar : SCRIPT_NAME 為 /index.php , PATH_INFO 為 /foo/bar
+	if scriptName, pathInfo, ok := h.splitPathInfo(upath); ok {
+		return target{scriptName: scriptName, filename: h.filename(scriptName), pathInfo: pathInfo}, true
+	}
+
+	info, err := os.Stat(h.filename(upath))
+	if err == nil && info.IsDir() {
+		if !strings.HasSuffix(urlPath, "/") {
+			return target{redirect: path.Base(upath) + "/"}, true
+		}
+		for _, index := range h.indexFiles {
+			indexPath := path.Join(upath, index)
+			if info, err := os.Stat(h.filename(indexPath)); err == nil && !info.IsDir() {
+				return h.fileTarget(indexPath), true
+			}
+		}
+	} else if err == nil {
+		return h.fileTarget(upath), true
+	}
+
+	if h.frontController != "" {
+		return target{scriptName: h.frontController, filename: h.filename(h.frontController)}, true
+	}
+	return t, false
+}
+
+// fileTarget .php 交給 php-cgi , 其他以靜態檔案提供
+func (h *HTTPHandler) fileTarget(upath string) target {
+	t := target{filename: h.filename(upath)}
+	if isPHP(upath) {
+		t.scriptName = upath
+	}
+	return t
+}
+
+// isPHP 副檔名是否為 .php , 不分大小寫 , Windows 上 /config.PHP 開啟的就是 config.php
+func isPHP(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".php")
+}
+
+// unsafePath 路徑中是否有以 . 開頭的部分 (如 .git , .env) , 或 Windows 會另外解讀的名稱
+// NTFS 會忽略結尾的 . 及空白 , : 用來指定 alternate data stream (如 ::$DATA) , \ 是路徑分隔符號
+// 這些路徑可能開啟 .php 檔案 , 卻不以 .php 結尾而被當成靜態檔案送出原始碼
+func unsafePath(upath string) bool {
+	if strings.ContainsAny(upath, ":\\\x00") {
+		return true
+	}
+	for _, part := range strings.Split(upath, "/") {
+		if strings.HasPrefix(part, ".") || strings.HasSuffix(part, ".") || strings.HasSuffix(part, " ") {
+			return true
+		}
+	}
+	return false
+}
+
+// filename 將 URL 路徑轉為 DocumentRoot 中的檔案路徑 , upath 必須已經 path.Clean
+func (h *HTTPHandler) filename(upath string) string {
+	return filepath.Join(h.documentRoot, filepath.FromSlash(upath))
+}
+
+// splitPathInfo 找出路徑中第一個以 .php 結尾且存在的檔案 , 其後的部分為 PATH_INFO
+func (h *HTTPHandler) splitPathInfo(upath string) (scriptName string, pathInfo string, ok bool) {
+	for i := 1; i < len(upath); {
+		j := strings.Index(upath[i:], "/")
+		end := len(upath)
+		if j >= 0 {
+			end = i + j
+		}
+		if isPHP(upath[:end]) {
+			if info, err := os.Stat(h.filename(upath[:end])); err == nil && !info.IsDir() {
+				return upath[:end], upath[end:], true
+			}
+		}
+		i = end + 1
+	}
+	return "", "", false
+}
+
+// serveFile 以靜態檔案提供
+func (h *HTTPHandler) serveFile(w http.ResponseWriter, r *http.Request, filename string) {
+	f, err := os.Open(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// servePHP 以一個 idle 的 php-cgi 執行 t.filename , 沒有 idle 的 php-cgi 時等待到 client 中斷連線
+// body 在取得 php-cgi 之前就全部讀完 , 慢速上傳的 client 不會佔住 php-cgi
+func (h *HTTPHandler) servePHP(w http.ResponseWriter, r *http.Request, t target) {
+	ctx := r.Context()
+	if r.ContentLength > h.maxBody {
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	body, contentLength, closeBody, err := bufferBody(r.Body, h.maxBody)
+	if err == errBodyTooLarge {
+		// chunked 的要求 , 剩下的 body 不再讀取 , 回應後關閉連線
+		w.Header().Set("Connection", "close")
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		// 如 ReadTimeout 或 client 中斷上傳
+		if ctx.Err() == nil {
+			h.m.logger().WithFields(log.Fields{"remote_addr": r.RemoteAddr, "path": r.URL.Path}).WithError(err).Warn("Can not read request body")
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		}
+		return
+	}
+	defer closeBody()
+	params := h.params(r, t, contentLength)
+
+	p, err := h.m.connect(ctx, func() (*Process, error) {
+		return h.m.acquireContext(ctx)
+	})
+	if err == ErrRateLimited {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			h.m.logger().WithFields(log.Fields{"remote_addr": r.RemoteAddr, "path": r.URL.Path}).WithError(err).Error("Can not get php-cgi process")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		}
+		return
+	}
+	defer h.m.Release(p)
+	conn := p.pipe
+	defer watchContext(ctx, conn)()
+
+	// php-cgi 可能在讀完 stdin 之前就開始輸出 , 所以另外以 goroutine 送出要求
+	written := make(chan error, 1)
+	go func() {
+		written <- writeRequest(conn, params, body)
+	}()
+	defer func() {
+		// 中斷還沒寫完的要求 , body 已經讀進暫存 , 關閉 conn 後 writeRequest 就會返回
+		conn.Close()
+		<-written
+	}()
+
+	logger := p.requestLogger().WithFields(log.Fields{"remote_addr": r.RemoteAddr, "path": r.URL.Path})
+	br := bufio.NewReader(&stdoutReader{r: bufio.NewReader(conn), logger: logger})
+	header, err := textproto.NewReader(br).ReadMIMEHeader()
+	if err != nil && (err != io.EOF || len(header) == 0) {
+		if ctx.Err() == nil {
+			logger.WithError(err).Error("php-cgi invalid response")
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return
+	}
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		code, err := strconv.Atoi(strings.Fields(s)[0])
+		if err != nil || code < 100 || code > 999 {
+			logger.Errorf("php-cgi invalid Status %s", s)
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
+		}
+		status = code
+		header.Del("Status")
+	} else if header.Get("Location") != "" {
+		status = http.StatusFound
+	}
+	for k, v := range header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(status)
+	if _, err = io.Copy(w, br); err != nil && ctx.Err() == nil {
+		logger.WithError(err).Warn("php-cgi response is interrupted")
+	}
+}
+
+// bufferBody 讀取整個 body , 最多 max bytes , 超過 bodyMemoryLimit 的部分暫存至檔案
+// php-cgi 需要 CONTENT_LENGTH , chunked 的要求也必須先讀完 , 超過 max 時返回 errBodyTooLarge
+// 返回的 closeBody 用來刪除暫存檔
+func bufferBody(r io.Reader, max int64) (body io.Reader, n int64, closeBody func(), err error) {
+	closeBody = func() {}
+	lr := io.LimitReader(r, max+1)
+	var buf bytes.Buffer
+	if n, err = io.CopyN(&buf, lr, bodyMemoryLimit); err == io.EOF {
+		if n > max {
+			return nil, 0, closeBody, errBodyTooLarge
+		}
+		return bytes.NewReader(buf.Bytes()), n, closeBody, nil
+	}
+	if err != nil {
+		return nil, 0, closeBody, err
+	}
+
+	f, err := ioutil.TempFile("", "wphpfpm-body")
+	if err != nil {
+		return nil, 0, closeBody, err
+	}
+	closeBody = func() {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	written, err := io.Copy(f, lr)
+	n += written
+	if err == nil && n > max {
+		err = errBodyTooLarge
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		closeBody()
+		return nil, 0, func() {}, err
+	}
+	return io.MultiReader(&buf, f), n, closeBody, nil
+}
+
+// params 依 CGI/1.1 建立 FastCGI params
+func (h *HTTPHandler) params(r *http.Request, t target, contentLength int64) map[string]string {
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "wphpfpm",
+		"SERVER_PROTOCOL":   r.Proto,
+		"REQUEST_METHOD":    r.Method,
+		"REQUEST_URI":       r.RequestURI,
+		"QUERY_STRING":      r.URL.RawQuery,
+		"DOCUMENT_ROOT":     h.documentRoot,
+		"DOCUMENT_URI":      t.scriptName + t.pathInfo,
+		"SCRIPT_NAME":       t.scriptName,
+		"SCRIPT_FILENAME":   t.filename,
+		"PATH_INFO":         t.pathInfo,
+		"CONTENT_LENGTH":    strconv.FormatInt(contentLength, 10),
+		"CONTENT_TYPE":      r.Header.Get("Content-Type"),
+		"HTTP_HOST":         r.Host,
+		// php-cgi 的 cgi.force_redirect 需要
+		"REDIRECT_STATUS": "200",
+	}
+	if t.pathInfo != "" {
+		params["PATH_TRANSLATED"] = h.filename(t.pathInfo)
+	}
+	if r.TLS != nil {
+		params["HTTPS"] = "on"
+	}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		params["REMOTE_ADDR"], params["REMOTE_PORT"] = host, port
+	}
+	params["SERVER_NAME"] = r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		params["SERVER_NAME"] = host
+	}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+			params["SERVER_ADDR"], params["SERVER_PORT"] = host, port
+		}
+	}
+	for k, v := range r.Header {
+		switch k {
+		case "Content-Type", "Content-Length", "Proxy":
+			// Proxy 不轉送 , 避免 httpoxy (HTTP_PROXY)
+			continue
+		}
+		params["HTTP_"+strings.ToUpper(strings.Replace(k, "-", "_", -1))] = strings.Join(v, ", ")
+	}
+	return params
+}
+
+// writeRequest 送出 BEGIN_REQUEST , PARAMS 及 STDIN
+func writeRequest(w io.Writer, params map[string]string, stdin io.Reader) error {
+	bw := bufio.NewWriterSize(w, 8192)
+	// role = FCGI_RESPONDER , flags = 0 (處理完後 php-cgi 關閉連線)
+	fcgi.WriteRecord(bw, fcgi.TypeBeginRequest, 1, []byte{0, 1, 0, 0, 0, 0, 0, 0})
+	fcgi.WriteStream(bw, fcgi.TypeParams, 1, fcgi.EncodeParams(params))
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	buf := make([]byte, fcgi.MaxContentLength)
+	for {
+		n, err := stdin.Read(buf)
+		if n > 0 {
+			if werr := fcgi.WriteRecord(w, fcgi.TypeStdin, 1, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return fcgi.WriteRecord(w, fcgi.TypeStdin, 1, nil)
+}
+
+// stdoutReader 只讀出 STDOUT 的內容 , STDERR 寫進 log , 讀到 END_REQUEST 時返回 io.EOF
+type stdoutReader struct {
+	r      io.Reader
+	logger *log.Entry
+	rec    fcgi.Record
+	buf    []byte
+	done   bool
+}
+
+func (s *stdoutReader) Read(b []byte) (int, error) {
+	for len(s.buf) == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		if err := fcgi.ReadRecord(s.r, &s.rec); err != nil {
+			return 0, err
+		}
+		switch s.rec.Type {
+		case fcgi.TypeStdout:
+			s.buf = s.rec.Content
+		case fcgi.TypeStderr:
+			if len(s.rec.Content) > 0 {
+				s.logger.Warnf("php-cgi stderr : %s", strings.TrimSpace(string(s.rec.Content)))
+			}
+		case fcgi.TypeEndRequest:
+			s.done = true
+		}
+	}
+	n := copy(b, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+// aLongTimeAgo 設定為 deadline 時 , 進行中的讀寫會立刻失敗
+var aLongTimeAgo = time.Unix(1, 0)
+
+// watchContext ctx 結束時讓 conn 進行中的讀寫立刻失敗 , 返回的 func 用來停止監控
+func watchContext(ctx context.Context, conn net.Conn) func() {
+	stop := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,58 @@
+package phpfpm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHTTPResolve(t *testing.T) {
+	root, err := ioutil.TempDir("", "wphpfpm-resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"config.php", "upper.PHP", "static.txt", "sub/index.php"} {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte("<?php $password = 'secret';"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &HTTPHandler{documentRoot: root, indexFiles: defaultIndexFiles}
+
+	tests := []struct {
+		path       string
+		scriptName string
+		filename   string
+		pathInfo   string
+	}{
+		{"/config.php", "/config.php", "config.php", ""},
+		{"/config.php/a/b", "/config.php", "config.php", "/a/b"},
+		{"/upper.PHP", "/upper.PHP", "upper.PHP", ""},
+		{"/sub/", "/sub/index.php", "sub/index.php", ""},
+		{"/static.txt", "", "static.txt", ""},
+	}
+	for _, test := range tests {
+		target, ok := h.resolve(test.path)
+		if !ok || target.scriptName != test.scriptName || target.filename != filepath.Join(root, filepath.FromSlash(test.filename)) || target.pathInfo != test.pathInfo {
+			t.Errorf("resolve(%q) = %+v , %v", test.path, target, ok)
+		}
+	}
+
+	// Windows 上這些路徑都會開啟 config.php , 不可以被當成靜態檔案送出原始碼
+	h.frontController = "/config.php"
+	for _, path := range []string{"/config.php.", "/config.php ", "/config.php::$DATA", "/config.php:$DATA", "/sub\\..\\config.php", "/sub./index.php", "/config.php\x00.txt"} {
+		if target, ok := h.resolve(path); ok {
+			t.Errorf("resolve(%q) should be rejected , got %+v", path, target)
+		}
+	}
+	// 大小寫不同時 , Windows 上找得到檔案 , 也必須交給 php-cgi
+	if target, ok := h.resolve("/CONFIG.PHP"); ok && target.scriptName == "" {
+		t.Errorf("resolve(/CONFIG.PHP) should not be a static file , got %+v", target)
+	}
+	if target, ok := h.resolve("/missing"); !ok || target.scriptName != "/config.php" || target.filename != filepath.Join(root, "config.php") {
+		t.Errorf("front controller = %+v , %v", target, ok)
+	}
+}
@@ -0,0 +1,198 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	root, err := ioutil.TempDir("", "wphpfpm-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	files := map[string]string{
+		"index.php":      "",
+		"static.txt":     "static file",
+		".env":           "SECRET=1",
+		"upper.PHP":      "<?php echo 1;",
+		"docs/index.php": "",
+		"plain/a.html":   "",
+	}
+	for name, content := range files {
+		name = filepath.Join(root, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(name), 0755)
+		if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, DocumentRoot: root})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	h, err := NewHTTPHandler(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(method, target, strings.NewReader(body)))
+		return w
+	}
+	script := func(name string) string {
+		return "script=" + filepath.Join(root, name)
+	}
+
+	if w := serve("GET", "/static.txt", ""); w.Code != 200 || w.Body.String() != "static file" {
+		t.Errorf("static file : %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("GET", "/", ""); w.Code != 200 || !strings.Contains(w.Body.String(), script("index.php")) {
+		t.Errorf("index file : %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("GET", "/docs?a=1", ""); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "/docs/?a=1" {
+		t.Errorf("directory redirect : %d %v", w.Code, w.Header())
+	}
+	if w := serve("GET", "/docs/", ""); !strings.Contains(w.Body.String(), script("docs/index.php")) {
+		t.Errorf("directory index : %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("GET", "/index.php/foo/bar", ""); w.Header().Get("X-Path-Translated") != filepath.Join(root, "foo/bar") || !strings.Contains(w.Body.String(), script("index.php")) {
+		t.Errorf("PATH_TRANSLATED : %d %v %q", w.Code, w.Header(), w.Body.String())
+	}
+	if w := serve("POST", "/index.php", "a=1"); w.Header().Get("X-Body") != "a=1" {
+		t.Errorf("POST body : %d %v", w.Code, w.Header())
+	}
+	// chunked 的要求沒有 Content-Length
+	chunked := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/index.php", ioutil.NopCloser(strings.NewReader(body)))
+		r.ContentLength = -1
+		h.ServeHTTP(w, r)
+		return w
+	}
+	if w := chunked("b=2"); w.Header().Get("X-Body") != "b=2" {
+		t.Errorf("chunked body : %d %v", w.Code, w.Header())
+	}
+	h.maxBody = 4
+	if w := chunked("a=123"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked body too large : %d", w.Code)
+	}
+	if w := serve("POST", "/index.php", "a=123"); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("body too large : %d", w.Code)
+	}
+	if w := serve("POST", "/index.php", "a=1"); w.Header().Get("X-Body") != "a=1" {
+		t.Errorf("body within limit : %d %v", w.Code, w.Header())
+	}
+	h.maxBody = defaultMaxRequestBody * 1024 * 1024
+	if w := serve("GET", "/upper.PHP", ""); !strings.Contains(w.Body.String(), script("upper.PHP")) {
+		t.Errorf("upper case extension : %d %q", w.Code, w.Body.String())
+	}
+	for _, target := range []string{"/.env", "/missing", "/plain/", "/index.php.", "/index.php%20", "/index.php::$DATA", "/docs%5c..%5cindex.php"} {
+		if w := serve("GET", target, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s should be 404 , got %d", target, w.Code)
+		}
+	}
+
+	// 找不到檔案時交給 FrontController
+	h.frontController = "/index.php"
+	if w := serve("GET", "/blog/hello", ""); w.Code != 200 || !strings.Contains(w.Body.String(), script("index.php")) {
+		t.Errorf("front controller : %d %q", w.Code, w.Body.String())
+	}
+	if w := serve("GET", "/.env", ""); w.Code != http.StatusNotFound {
+		t.Errorf("hidden file should not reach front controller , got %d", w.Code)
+	}
+	if stats := m.Stats(); stats.Idle != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestHTTPHandlerBufferBody(t *testing.T) {
+	root, err := ioutil.TempDir("", "wphpfpm-http")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	ioutil.WriteFile(filepath.Join(root, "index.php"), nil, 0644)
+
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, DocumentRoot: root})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	h, err := NewHTTPHandler(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 慢速上傳時還沒有取得 php-cgi , 其他要求不受影響
+	pr, pw := io.Pipe()
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/index.php", pr)
+		r.ContentLength = -1
+		h.ServeHTTP(w, r)
+		done <- w
+	}()
+	pw.Write([]byte("a="))
+	if stats := m.Stats(); stats.Busy != 0 {
+		t.Errorf("php-cgi is acquired before the body is read %+v", stats)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/index.php", nil))
+	if w.Code != 200 {
+		t.Errorf("other request : %d", w.Code)
+	}
+	pw.Write([]byte("1"))
+	pw.Close()
+	select {
+	case w := <-done:
+		if w.Header().Get("X-Body") != "a=1" {
+			t.Errorf("slow body : %d %v", w.Code, w.Header())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request is not finished")
+	}
+
+	// 超過 bodyMemoryLimit 的部分暫存至檔案
+	defer func(n int64) { bodyMemoryLimit = n }(bodyMemoryLimit)
+	bodyMemoryLimit = 4
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/index.php", strings.NewReader("a=123456")))
+	if w.Header().Get("X-Body") != "a=123456" {
+		t.Errorf("body in temp file : %d %v", w.Code, w.Header())
+	}
+	h.maxBody = 6
+	r := httptest.NewRequest("POST", "/index.php", ioutil.NopCloser(strings.NewReader("a=123456")))
+	r.ContentLength = -1
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked body in temp file too large : %d", w.Code)
+	}
+
+	// client 中斷上傳時返回 400 , 不會取得 php-cgi
+	pr, pw = io.Pipe()
+	pw.CloseWithError(io.ErrUnexpectedEOF)
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/index.php", pr))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("interrupted body : %d", w.Code)
+	}
+	if stats := m.Stats(); stats.Idle != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
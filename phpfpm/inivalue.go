@@ -0,0 +1,32 @@
+package phpfpm
+
+import (
+	"sort"
+	"wphpfpm/conf"
+)
+
+// iniArgs 將 Instance 的 PHPValues 及 PHPAdminValues 轉為啟動 php-cgi 的 -d key=value
+// php-cgi -b 不處理 PHP_VALUE 及 PHP_ADMIN_VALUE (只有 php-fpm 會) , 所以只在啟動時帶入 , 不改寫要求的 PARAMS
+// 兩者相同 key 時以 PHPAdminValues 為準 , 沒有設定時返回 nil
+func iniArgs(instance conf.Instance) []string {
+	values := make(map[string]string, len(instance.PHPValues)+len(instance.PHPAdminValues))
+	for key, value := range instance.PHPValues {
+		values[key] = value
+	}
+	for key, value := range instance.PHPAdminValues {
+		values[key] = value
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	args := make([]string, 0, len(keys)*2)
+	for _, key := range keys {
+		args = append(args, "-d", key+"="+values[key])
+	}
+	return args
+}
@@ -0,0 +1,25 @@
+package phpfpm
+
+import (
+	"reflect"
+	"testing"
+	"wphpfpm/conf"
+)
+
+func TestIniArgs(t *testing.T) {
+	if args := iniArgs(conf.Instance{}); args != nil {
+		t.Errorf("expected nil , got %v", args)
+	}
+	args := iniArgs(conf.Instance{
+		PHPValues:      map[string]string{"memory_limit": "256M", "upload_max_filesize": "8M"},
+		PHPAdminValues: map[string]string{"upload_max_filesize": "2M", "allow_url_fopen": "Off"},
+	})
+	expected := []string{
+		"-d", "allow_url_fopen=Off",
+		"-d", "memory_limit=256M",
+		"-d", "upload_max_filesize=2M",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("expected %v , got %v", expected, args)
+	}
+}
@@ -0,0 +1,184 @@
+package phpfpm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+	"wphpfpm/conf"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitsEnv 以這個環境變數傳入 JSON 格式的 limitsWrapper , 代表 wphpfpm 是以 limits wrapper 啟動的
+const limitsEnv = "WPHPFPM_LIMITS"
+
+// limitsStatusFd wrapper 套用 Limits 失敗時 , 將錯誤寫入這個 fd (cmd.ExtraFiles[0]) , 成功 exec 時自動關閉
+const limitsStatusFd = 3
+
+// limitsWrapper wrapper 需要的資料 , Path 為 php-cgi 的路徑 , php-cgi 的參數即 wrapper 的 os.Args
+type limitsWrapper struct {
+	Path   string
+	Limits *conf.Limits
+	Cred   *credential
+}
+
+// checkLimits Linux 支援所有的 Limits
+func checkLimits(limits *conf.Limits) error {
+	return nil
+}
+
+// startWithLimits 以 wphpfpm 本身作為 wrapper 啟動 php-cgi
+// wrapper 先對自己套用 Limits , 再切換為 cred 的身分 , 最後 exec php-cgi , 所以 php-cgi 及它 fork 的行程從一開始就受到限制
+// 返回時 php-cgi 已經 exec , 或套用失敗並已經結束
+func startWithLimits(cmd *exec.Cmd, limits *conf.Limits, cred *credential) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(limitsWrapper{Path: cmd.Path, Limits: limits, Cred: cred})
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	// wrapper 需要 root 的權限才能提高 hard limit 或設定負的 Nice , 所以由 wrapper 自己切換身分
+	cmd.Path = exe
+	cmd.Env = append(cmd.Env, limitsEnv+"="+string(b))
+	cmd.ExtraFiles = []*os.File{w}
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	// exec 成功時 fd 被關閉 , 讀到 EOF
+	msg, _ := ioutil.ReadAll(r)
+	if len(msg) > 0 {
+		cmd.Wait()
+		return fmt.Errorf("apply limits error , %s", msg)
+	}
+	return nil
+}
+
+// RunLimitsWrapper 以 limits wrapper 啟動時 , 套用 Limits 並切換身分後 exec php-cgi , 不會返回
+// 必須在 main (及 TestMain) 的最前面呼叫 , 不是 wrapper 時不做任何事
+func RunLimitsWrapper() {
+	s, ok := os.LookupEnv(limitsEnv)
+	if !ok {
+		return
+	}
+	err := execWithLimits(s)
+	// 只有失敗時才會執行到這裡
+	os.NewFile(limitsStatusFd, "limits-status").WriteString(err.Error())
+	os.Exit(127)
+}
+
+// execWithLimits 套用 Limits , 切換身分 , 然後 exec php-cgi
+func execWithLimits(s string) error {
+	var w limitsWrapper
+	if err := json.Unmarshal([]byte(s), &w); err != nil {
+		return err
+	}
+	// Nice , CPUAffinity 及切換身分都只作用在目前的 thread , 必須在同一個 thread 上 exec
+	runtime.LockOSThread()
+	if err := applyLimits(0, w.Limits); err != nil {
+		return err
+	}
+	if w.Cred != nil {
+		if err := switchCredential(w.Cred); err != nil {
+			return err
+		}
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, limitsEnv+"=") {
+			env = append(env, e)
+		}
+	}
+	unix.CloseOnExec(limitsStatusFd)
+	return syscall.Exec(w.Path, os.Args, env)
+}
+
+// switchCredential 切換為 cred 的群組及使用者 , 同 SysProcAttr.Credential
+func switchCredential(cred *credential) error {
+	if !cred.NoSetGroups {
+		groups := make([]int, len(cred.Groups))
+		for i, g := range cred.Groups {
+			groups[i] = int(g)
+		}
+		if err := unix.Setgroups(groups); err != nil {
+			return fmt.Errorf("setgroups : %s", err.Error())
+		}
+	}
+	if err := unix.Setresgid(int(cred.Gid), int(cred.Gid), int(cred.Gid)); err != nil {
+		return fmt.Errorf("setgid : %s", err.Error())
+	}
+	if err := unix.Setresuid(int(cred.Uid), int(cred.Uid), int(cred.Uid)); err != nil {
+		return fmt.Errorf("setuid : %s", err.Error())
+	}
+	return nil
+}
+
+// applyLimits 對 pid 設定資源限制 , 0 代表目前的行程 (Nice 及 CPUAffinity 為目前的 thread)
+func applyLimits(pid int, limits *conf.Limits) error {
+	rlimits := []struct {
+		resource int
+		value    *uint64
+		unit     uint64
+	}{
+		{unix.RLIMIT_AS, limits.MaxAddressSpace, 1024 * 1024},
+		{unix.RLIMIT_CPU, limits.MaxCPUTime, 1},
+		{unix.RLIMIT_NOFILE, limits.MaxOpenFiles, 1},
+		{unix.RLIMIT_CORE, limits.MaxCoreSize, 1024 * 1024},
+	}
+	for _, r := range rlimits {
+		if r.value == nil {
+			continue
+		}
+		v := *r.value * r.unit
+		if err := prlimit(pid, r.resource, v); err != nil {
+			return err
+		}
+	}
+
+	if limits.Nice != 0 {
+		if err := unix.Setpriority(unix.PRIO_PROCESS, pid, limits.Nice); err != nil {
+			return err
+		}
+	}
+
+	if len(limits.CPUAffinity) > 0 {
+		var set unix.CPUSet
+		for _, cpu := range limits.CPUAffinity {
+			set.Set(cpu)
+		}
+		if err := unix.SchedSetaffinity(pid, &set); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rlimit64 是 prlimit64 使用的結構 , 所有架構都是 64 位元
+type rlimit64 struct {
+	Cur uint64
+	Max uint64
+}
+
+// prlimit 設定行程的 soft 及 hard limit
+func prlimit(pid int, resource int, value uint64) error {
+	limit := rlimit64{Cur: value, Max: value}
+	_, _, errno := unix.RawSyscall6(unix.SYS_PRLIMIT64, uintptr(pid), uintptr(resource), uintptr(unsafe.Pointer(&limit)), 0, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
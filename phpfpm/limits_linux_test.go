@@ -0,0 +1,71 @@
+package phpfpm
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+	"wphpfpm/conf"
+)
+
+// procField 返回 /proc/pid/file 中以 prefix 開頭的那一行
+func procField(t *testing.T, pid int, file string, prefix string) string {
+	b, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+	t.Fatalf("%s not found in /proc/%d/%s", prefix, pid, file)
+	return ""
+}
+
+func TestLimits(t *testing.T) {
+	openFiles, coreSize := uint64(200), uint64(0)
+	limits := &conf.Limits{MaxOpenFiles: &openFiles, MaxCoreSize: &coreSize, Nice: 5, CPUAffinity: []int{0}}
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, Limits: limits})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	p := m.Acquire()
+	defer m.Release(p)
+	pid := p.cmd.Process.Pid
+
+	// wrapper 已經 exec 為 php-cgi , 限制在 exec 之前就已經套用
+	if cmdline, _ := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/cmdline"); !strings.Contains(string(cmdline), "\x00-b\x00") {
+		t.Errorf("php-cgi is not executed : %q", cmdline)
+	}
+	if fields := strings.Fields(procField(t, pid, "limits", "Max open files")); fields[3] != "200" || fields[4] != "200" {
+		t.Errorf("Max open files = %v", fields)
+	}
+	if fields := strings.Fields(procField(t, pid, "limits", "Max core file size")); fields[4] != "0" {
+		t.Errorf("Max core file size = %v", fields)
+	}
+	if line := procField(t, pid, "status", "Cpus_allowed_list:"); strings.TrimSpace(strings.TrimPrefix(line, "Cpus_allowed_list:")) != "0" {
+		t.Errorf("CPUAffinity = %s", line)
+	}
+	stat, _ := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	// comm 之後的第 17 個欄位是 nice
+	if fields := strings.Fields(string(stat[strings.LastIndex(string(stat), ")")+1:])); fields[16] != "5" {
+		t.Errorf("nice = %s", fields[16])
+	}
+	if environ, _ := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/environ"); strings.Contains(string(environ), limitsEnv) {
+		t.Errorf("%s should not be passed to php-cgi", limitsEnv)
+	}
+}
+
+func TestLimitsError(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, Limits: &conf.Limits{CPUAffinity: []int{1023}}})
+	err := m.Start()
+	if err == nil {
+		m.Stop()
+		t.Fatal("expected error for invalid CPUAffinity")
+	}
+	if !strings.Contains(err.Error(), "apply limits error") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
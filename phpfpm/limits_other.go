@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package phpfpm
+
+import (
+	"errors"
+	"os/exec"
+	"wphpfpm/conf"
+)
+
+// checkLimits 只有 Linux 支援 Limits
+func checkLimits(limits *conf.Limits) error {
+	return errors.New("Limits are only supported on linux")
+}
+
+// startWithLimits 只有 Linux 支援 Limits
+func startWithLimits(cmd *exec.Cmd, limits *conf.Limits, cred *credential) error {
+	return checkLimits(limits)
+}
+
+// RunLimitsWrapper 只有 Linux 會以 limits wrapper 啟動 php-cgi
+func RunLimitsWrapper() {
+}
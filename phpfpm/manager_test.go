@@ -0,0 +1,530 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+	wfcgi "wphpfpm/fcgi"
+	"wphpfpm/hook"
+)
+
+// TestMain 設定 WPHPFPM_FAKE_PHP_CGI 時 , 測試程式本身當作 php-cgi 執行 , 也可以當作 limits wrapper
+func TestMain(m *testing.M) {
+	RunLimitsWrapper()
+	if os.Getenv("WPHPFPM_FAKE_PHP_CGI") == "1" {
+		fakePHPCGI()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakePHPCGI 同 php-cgi -b , 在 unix socket 上提供 FastCGI 服務
+func fakePHPCGI() {
+	var bind string
+	var ini []string
+	for i := 1; i < len(os.Args)-1; i++ {
+		switch os.Args[i] {
+		case "-b":
+			bind = os.Args[i+1]
+		case "-d":
+			ini = append(ini, os.Args[i+1])
+		}
+	}
+	if name := os.Getenv("WPHPFPM_FAKE_SLOW_START"); name != "" {
+		// 這個檔案存在時延遲啟動 , 模擬需要數秒才能啟動的 php-cgi
+		if _, err := os.Stat(name); err == nil {
+			time.Sleep(time.Second)
+		}
+	}
+	l, err := net.Listen("unix", bind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if len(body) > 0 {
+			w.Header().Set("X-Body", string(body))
+		}
+		if len(ini) > 0 {
+			w.Header().Set("X-Ini", strings.Join(ini, ";"))
+		}
+		env := fcgi.ProcessEnv(r)
+		if env["PHP_VALUE"] != "" || env["PHP_ADMIN_VALUE"] != "" {
+			w.Header().Set("X-PHP-Value", env["PHP_VALUE"]+env["PHP_ADMIN_VALUE"])
+		}
+		// net/http/fcgi 不會在 ProcessEnv 提供 PATH_INFO
+		if env["PATH_TRANSLATED"] != "" {
+			w.Header().Set("X-Path-Translated", env["PATH_TRANSLATED"])
+		}
+		if name := os.Getenv("WPHPFPM_FAKE_LOG"); name != "" {
+			// 記錄收到的要求 , 供 warmup 等測試檢查
+			if f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err == nil {
+				fmt.Fprintf(f, "%s %s\n", env["SCRIPT_FILENAME"], env["SERVER_NAME"])
+				f.Close()
+			}
+		}
+		if strings.HasSuffix(r.URL.Path, "missing.php") {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		if name := os.Getenv("WPHPFPM_FAKE_FAIL"); name != "" && strings.HasSuffix(env["SCRIPT_FILENAME"], "fail.php") {
+			// 這個檔案存在時 fail.php 返回 500
+			if _, err := os.Stat(name); err == nil {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+		}
+		fmt.Fprintf(w, "pid=%d script=%s", os.Getpid(), env["SCRIPT_FILENAME"])
+	}))
+}
+
+func newTestManager(t *testing.T, instance conf.Instance) *Manager {
+	instance.ExecPath = os.Args[0]
+	instance.Env = append(instance.Env, "WPHPFPM_FAKE_PHP_CGI=1")
+	m, err := NewManager(instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestManager(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 2})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Start(); err != ErrAlreadyRunning {
+		t.Errorf("expected ErrAlreadyRunning , got %v", err)
+	}
+	if stats := m.Stats(); stats.Processes != 2 || stats.Idle != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	p1, p2 := m.Acquire(), m.Acquire()
+	if p1 == nil || p2 == nil || p1 == p2 {
+		t.Fatal("expected 2 different processes")
+	}
+	if m.Acquire() != nil {
+		t.Error("pool should be exhausted")
+	}
+	if stats := m.Stats(); stats.Busy != 2 || stats.Idle != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	m.Release(p1)
+	m.Release(p2)
+	if stats := m.Stats(); stats.Idle != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	m.Stop()
+	if m.Acquire() != nil {
+		t.Error("stopped manager should not return a process")
+	}
+	if _, err := os.Stat(pipeDir(m.id)); !os.IsNotExist(err) {
+		t.Errorf("pipe directory should be removed : %v", err)
+	}
+
+	// Stop 之後可以再次 Start
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if stats := m.Stats(); stats.Idle != 2 {
+		t.Errorf("unexpected stats after restart %+v", stats)
+	}
+}
+
+func TestManagerDo(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1})
+	ctx := context.Background()
+	if _, err := m.Do(ctx, nil, nil); err != ErrNotRunning {
+		t.Errorf("expected ErrNotRunning , got %v", err)
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	params := map[string]string{
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_METHOD":  "POST",
+		"SCRIPT_FILENAME": "/index.php",
+		"REQUEST_URI":     "/index.php",
+	}
+	resp, err := m.Do(ctx, params, strings.NewReader("a=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 200 || resp.Header.Get("X-Body") != "a=1" || !bytes.Contains(resp.Body, []byte("script=/index.php")) {
+		t.Errorf("unexpected response %d %v %q", resp.Status, resp.Header, resp.Body)
+	}
+
+	params["SCRIPT_FILENAME"], params["REQUEST_URI"] = "/missing.php", "/missing.php"
+	resp, err = m.Do(ctx, params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != 404 || resp.Header.Get("Status") != "" {
+		t.Errorf("unexpected response %d %v", resp.Status, resp.Header)
+	}
+	if stats := m.Stats(); stats.Idle != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+func TestManagerIniArgs(t *testing.T) {
+	m := newTestManager(t, conf.Instance{
+		MaxProcesses:   1,
+		PHPValues:      map[string]string{"memory_limit": "256M", "display_errors": "On"},
+		PHPAdminValues: map[string]string{"display_errors": "Off"},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	params := map[string]string{
+		"SERVER_PROTOCOL": "HTTP/1.1",
+		"REQUEST_METHOD":  "GET",
+		"SCRIPT_FILENAME": "/index.php",
+	}
+	resp, err := m.Do(context.Background(), params, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ini := resp.Header.Get("X-Ini"); ini != "display_errors=Off;memory_limit=256M" {
+		t.Errorf("unexpected -d args %q", ini)
+	}
+	// php-cgi 不處理 PHP_VALUE , 不應該再送出
+	if v := resp.Header.Get("X-PHP-Value"); v != "" {
+		t.Errorf("PHP_VALUE should not be sent , got %q", v)
+	}
+}
+
+func TestManagerDial(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	conn, err := m.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := m.Stats(); stats.Busy != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	// 沒有 idle 的 php-cgi 時等待到 ctx 結束
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := m.Dial(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded , got %v", err)
+	}
+
+	// Close 之後 , 等待中的 Dial 可以取得同一個 php-cgi
+	dialed := make(chan error, 1)
+	go func() {
+		c, err := m.Dial(context.Background())
+		if err == nil {
+			c.Close()
+		}
+		dialed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	conn.Close()
+	conn.Close()
+	select {
+	case err := <-dialed:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("waiting Dial was not woken up")
+	}
+	if stats := m.Stats(); stats.Idle != 1 || stats.Busy != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
+
+// chanSink 將收到的事件送進 channel
+type chanSink chan hook.Event
+
+func (s chanSink) Send(ctx context.Context, e hook.Event) error {
+	s <- e
+	return nil
+}
+
+func TestManagerEvents(t *testing.T) {
+	sink := make(chanSink, 10)
+	bus := hook.NewBus()
+	bus.Add("test", sink, hook.Options{})
+	defer bus.Close(context.Background())
+
+	m := newTestManager(t, conf.Instance{Name: "events", MaxProcesses: 1})
+	m.SetEvents(bus)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	p, err := m.tryAcquire()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.tryAcquire(); err != ErrNoIdleProcess {
+		t.Errorf("expected ErrNoIdleProcess , got %v", err)
+	}
+	proc := p.cmd.Process
+	pid := proc.Pid
+	m.Release(p)
+	proc.Kill()
+
+	for _, expected := range []hook.Type{hook.PoolExhausted, hook.ProcessCrashed} {
+		select {
+		case e := <-sink:
+			if e.Type != expected || e.Source != "events" {
+				t.Errorf("expected %s event from events , got %+v", expected, e)
+			}
+			if e.Type == hook.ProcessCrashed && e.PID != pid {
+				t.Errorf("expected pid %d , got %d", pid, e.PID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s event is not published", expected)
+		}
+	}
+}
+
+// TestManagerStopAfterRestartFailed php-cgi 異常結束後無法重新啟動 (執行檔被刪除) , Stop 不可以 panic
+func TestManagerStopAfterRestartFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b, err := ioutil.ReadFile(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	execPath := filepath.Join(dir, "php-cgi")
+	if err := ioutil.WriteFile(execPath, b, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := make(chanSink, 10)
+	bus := hook.NewBus()
+	bus.Add("test", sink, hook.Options{Events: []hook.Type{hook.RestartFailed}})
+	defer bus.Close(context.Background())
+
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1})
+	m.instance.ExecPath = execPath
+	m.SetEvents(bus)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(execPath)
+	m.mutex.Lock()
+	proc := m.processes[0].cmd.Process
+	m.mutex.Unlock()
+	proc.Kill()
+
+	select {
+	case <-sink:
+	case <-time.After(5 * time.Second):
+		t.Fatal("restart failed event is not published")
+	}
+	m.Stop()
+}
+
+// TestManagerRestartWithoutLock 異常結束的 php-cgi 重新啟動期間 , 其他 php-cgi 仍可以被取得
+func TestManagerRestartWithoutLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	slow := filepath.Join(dir, "slow")
+
+	m := newTestManager(t, conf.Instance{MaxProcesses: 2, Env: []string{"WPHPFPM_FAKE_SLOW_START=" + slow}})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	ioutil.WriteFile(slow, nil, 0644)
+
+	p := m.Acquire()
+	proc := p.cmd.Process
+	m.Release(p)
+	proc.Kill()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.mutex.Lock()
+		restarting := p.restarting
+		m.mutex.Unlock()
+		if restarting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("php-cgi is not restarted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	start := time.Now()
+	other := m.Acquire()
+	if other == nil || other == p {
+		t.Fatal("expected the other idle process")
+	}
+	m.Release(other)
+	if stats := m.Stats(); stats.Busy != 1 || stats.Idle != 1 {
+		t.Errorf("unexpected stats while restarting %+v", stats)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Acquire and Stats are blocked by the restart for %s", elapsed)
+	}
+
+	// 重新啟動完成後放回 idle
+	for m.Stats().Idle != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("restarted process is not idle %+v", m.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestDispatchCloseAfterResponse php-cgi 回應後關閉連線 (沒有 FCGI_KEEP_CONN) , client 的連線也必須關閉
+func TestDispatchCloseAfterResponse(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		m.Dispatch(conn)
+		conn.Close()
+	}()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php", "REQUEST_URI": "/index.php"}
+	if err := writeRequest(client, params, strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+	// client 沒有關閉寫入端 , 如同 keep-alive 的 client 等待送出下一個要求
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("connection is not closed after the response : %v", err)
+	}
+	if !bytes.Contains(b, []byte("script=/index.php")) {
+		t.Errorf("unexpected response %q", b)
+	}
+}
+
+// TestRoutedDispatch 同 main 的 Routes : 讀取 head 後選擇 Instance , 清除 FCGI_KEEP_CONN , 再把 head 轉送給目標的 php-cgi
+func TestRoutedDispatch(t *testing.T) {
+	php7 := newTestManager(t, conf.Instance{Name: "php7", MaxProcesses: 1})
+	php8 := newTestManager(t, conf.Instance{Name: "php8", MaxProcesses: 1})
+	for _, m := range []*Manager{php7, php8} {
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer m.Stop()
+	}
+	router, err := NewRouter([]conf.Route{{Param: "SERVER_NAME", Equals: "php8.example.com", Instance: "php8"}}, map[string]*Manager{"php7": php7, "php8": php8})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				head, params, err := wfcgi.ReadHead(conn)
+				if err != nil {
+					return
+				}
+				wfcgi.ClearKeepConn(head)
+				m := php7
+				if target := router.Route(params); target != nil {
+					m = target
+				}
+				m.DispatchContext(context.Background(), NewReplayConn(conn, head))
+			}(conn)
+		}
+	}()
+
+	request := func(serverName string) string {
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		params := map[string]string{"REQUEST_METHOD": "GET", "SERVER_PROTOCOL": "HTTP/1.1", "SCRIPT_FILENAME": "/index.php", "SERVER_NAME": serverName}
+		// 如同 nginx 的 fastcgi_keep_conn on
+		wfcgi.WriteRecord(client, wfcgi.TypeBeginRequest, 1, []byte{0, 1, wfcgi.FlagKeepConn, 0, 0, 0, 0, 0})
+		wfcgi.WriteStream(client, wfcgi.TypeParams, 1, wfcgi.EncodeParams(params))
+		wfcgi.WriteRecord(client, wfcgi.TypeStdin, 1, nil)
+		// FCGI_KEEP_CONN 已經被清除 , php-cgi 回應後連線會被關閉
+		client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, err := ioutil.ReadAll(client)
+		if err != nil {
+			t.Fatalf("routed connection is not closed after the response : %v", err)
+		}
+		return string(b)
+	}
+
+	for _, c := range []struct {
+		serverName string
+		m          *Manager
+	}{{"php8.example.com", php8}, {"www.example.com", php7}} {
+		pid := fmt.Sprintf("pid=%d ", pidOf(c.m, c.m.processes[0]))
+		if b := request(c.serverName); !strings.Contains(b, pid) {
+			t.Errorf("%s should be handled by %s (%s) : %q", c.serverName, c.m.Instance().Name, pid, b)
+		}
+	}
+	// client 讀到 EOF 時 , php-cgi 可能還沒放回 idle
+	for _, m := range []*Manager{php7, php8} {
+		deadline := time.Now().Add(5 * time.Second)
+		for stats := m.Stats(); stats.Idle != 1 || stats.Busy != 0; stats = m.Stats() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s unexpected stats %+v", m.Instance().Name, stats)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
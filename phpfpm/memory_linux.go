@@ -0,0 +1,32 @@
+package phpfpm
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkMemory Linux 由 /proc 取得記憶體用量
+func checkMemory() error {
+	return nil
+}
+
+// processRSS 返回行程目前的 RSS , 單位是 byte
+func processRSS(pid int) (uint64, error) {
+	// statm 的第二個欄位是 resident pages
+	b, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/statm", pid))
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected /proc/%d/statm format", pid)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
@@ -0,0 +1,53 @@
+package phpfpm
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+)
+
+func TestProcessRSS(t *testing.T) {
+	rss, err := processRSS(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rss < 1024*1024 {
+		t.Errorf("unexpected RSS %d", rss)
+	}
+	if _, err := processRSS(-1); err == nil {
+		t.Error("expected error for invalid pid")
+	}
+}
+
+func TestRecycleMaxMemoryPerProcess(t *testing.T) {
+	defer func(d time.Duration) { memorySampleInterval = d }(memorySampleInterval)
+	memorySampleInterval = 20 * time.Millisecond
+	// 假的 php-cgi (Go 程式) 的 RSS 一定超過 1 MB
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, MaxMemoryPerProcess: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	p := m.Acquire()
+	pid := pidOf(m, p)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		reason := reasonOf(m, p)
+		if strings.HasPrefix(reason, "uses ") && strings.HasSuffix(reason, " MB memory") {
+			break
+		}
+		if reason != "" || time.Now().After(deadline) {
+			t.Fatalf("unexpected reason %q", reason)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Release 時重新啟動
+	m.Release(p)
+	if p = m.Acquire(); pidOf(m, p) == pid {
+		t.Error("php-cgi is not restarted after MaxMemoryPerProcess")
+	}
+	m.Release(p)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package phpfpm
+
+import "errors"
+
+// checkMemory 只有 Linux 及 Windows 支援 MaxMemoryPerProcess
+func checkMemory() error {
+	return errors.New("MaxMemoryPerProcess is only supported on linux and windows")
+}
+
+// processRSS 只有 Linux 及 Windows 支援
+func processRSS(pid int) (uint64, error) {
+	return 0, checkMemory()
+}
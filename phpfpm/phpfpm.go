@@ -2,165 +2,452 @@ package phpfpm
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 	"wphpfpm/conf"
+	"wphpfpm/hook"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// Instance : struct
-type Instance struct {
-	execPath  string
-	args      []string
-	env       []string
-	processes []Process
+// Manager : 一個 Instance 的 php-cgi pool
+// 同一個程式中可以建立多個 Manager , Stop 之後也可以再次 Start
+type Manager struct {
+	// 以 atomic 存取的計數器放在最前面 , 確保 32 bit 平台上 64 bit 對齊
+	restarts       uint64 // php-cgi 重新啟動的次數
+	connectRetries uint64 // 無法連線 php-cgi 而換另一個 php-cgi 重試的次數
+	rateLimited    uint64 // 超過 RateLimit 被拒絕的要求數量
+	rateQueued     uint64 // 超過 RateLimit 而等待的要求數量
+
+	instance       conf.Instance
+	id             int          // 用來區分每個 Manager 的 pipe 名稱
+	iniArgs        []string     // PHPValues 及 PHPAdminValues 轉成的 -d 參數
+	cred           *credential  // php-cgi 執行的身分 , nil 代表與 wphpfpm 相同
+	selector       strategy     // 從 idle 選出 php-cgi 的方式
+	limiter        *rateLimiter // RateLimit , 沒有設定時為 nil
+	events         *hook.Bus    // 事件通知 , nil 代表不通知
+	startupTimeout time.Duration
+
+	mutex     sync.Mutex
+	idle      *list.List // php-cgi 如果沒有任何連線處理，都存在這
+	processes []*Process // 所有的 Process , 包含處理中的
+	running   bool
+	done      chan struct{} // Stop() 時關閉 , 通知 monMemory 結束
+	idleCh    chan struct{} // 有 php-cgi 放回 idle 或 Stop() 時關閉並替換 , 通知等待中的 Dial
+}
+
+// Stats : Manager 目前的狀態
+type Stats struct {
+	Processes      int    // php-cgi 的數量
+	Idle           int    // 閒置中
+	Busy           int    // 處理中 (包含重新啟動中的)
+	Unhealthy      int    // warmup 失敗 , 等待重新啟動
+	Restarts       uint64 // 重新啟動的次數
+	ConnectRetries uint64 // 無法連線 php-cgi 而重試的次數
+	RateLimited    uint64 // 超過 RateLimit 被拒絕的要求數量
+	RateQueued     uint64 // 超過 RateLimit 而等待的要求數量
 }
 
 var (
-	// conf 是 json 讀進來後產生的設定
-	phpfpmConf *conf.Conf
-	// idleProcesses php-cgi 如果沒有任何連線處理，都存在這
-	idleProcesses []*list.List
-	stopManage    = false // 如果調用 Stop() , 這個會是 true , 同時 mon() 也不會繼續監控
-	mutex         sync.Mutex
+	// ErrAlreadyRunning Manager 已經 Start 了
+	ErrAlreadyRunning = errors.New("phpfpm manager is already running")
+	// ErrNotRunning Manager 還沒有 Start 或已經 Stop 了
+	ErrNotRunning = errors.New("phpfpm manager is not running")
 )
 
-// Conf : get Json config
-func Conf() *conf.Conf {
-	return phpfpmConf
-}
-
-// Start php-cgi manager
-func Start(conf *conf.Conf) (err error) {
-	log.Info("phpfpm starting.")
-	phpfpmConf = conf
-	instanceLen := len(conf.Instances)
-	idleProcesses = make([]*list.List, instanceLen)
-	for i := 0; i < instanceLen; i++ {
-		idleProcesses[i] = list.New()
-
-		for j := 0; j < conf.Instances[i].MaxProcesses; j++ {
-			instance := conf.Instances[i]
-			p := newProcess(instance.ExecPath, instance.Args, instance.Env)
-			p.instanceIndex = i
-			err := p.TryStart()
-			if err == nil {
-				mutex.Lock()
-				p.mapElement = idleProcesses[i].PushBack(p)
-				mutex.Unlock()
-				go monProcess(p)
-			} else {
-				Stop()
-				return err
-			}
+var (
+	// memorySampleInterval 每隔多久取樣一次 php-cgi 的記憶體用量
+	memorySampleInterval = 5 * time.Second
+	// lastManagerID 最後一個 Manager 的 id
+	lastManagerID int32
+)
+
+// NewManager 依據 instance 建立 Manager , 並檢查 instance 的設定在此平台是否可以使用
+// MaxProcesses 及 MaxRequestsPerProcess 小於 1 時使用預設值 4 及 500
+func NewManager(instance conf.Instance) (*Manager, error) {
+	if instance.MaxProcesses < 1 {
+		instance.MaxProcesses = 4
+	}
+	if instance.MaxRequestsPerProcess < 1 {
+		instance.MaxRequestsPerProcess = 500
+	}
+	cred, err := newCredential(instance)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Limits != nil {
+		if err = checkLimits(instance.Limits); err != nil {
+			return nil, err
 		}
 	}
-	log.Info("phpfpm is in loop.")
-	return
+	if instance.MaxMemoryPerProcess > 0 {
+		if err = checkMemory(); err != nil {
+			return nil, err
+		}
+	}
+	m := &Manager{
+		instance:       instance,
+		id:             int(atomic.AddInt32(&lastManagerID, 1)),
+		iniArgs:        iniArgs(instance),
+		cred:           cred,
+		selector:       newStrategy(instance.Strategy),
+		limiter:        newRateLimiter(instance),
+		startupTimeout: defaultStartupTimeout,
+	}
+	if instance.StartupTimeout > 0 {
+		m.startupTimeout = time.Duration(instance.StartupTimeout) * time.Second
+	}
+	return m, nil
+}
+
+// SetEvents 設定發生 php-cgi 異常結束等事件時通知的 Bus , 必須在 Start 之前呼叫
+func (m *Manager) SetEvents(b *hook.Bus) {
+	m.events = b
+}
+
+// publish 送出事件 , p 不是 nil 時帶上 php-cgi 的 pid
+func (m *Manager) publish(t hook.Type, p *Process, format string, args ...interface{}) {
+	if m.events == nil {
+		return
+	}
+	e := hook.Event{Type: t, Source: m.instanceName(), Message: fmt.Sprintf(format, args...)}
+	if p != nil && p.cmd != nil && p.cmd.Process != nil {
+		e.PID = p.cmd.Process.Pid
+	}
+	m.events.Publish(e)
+}
+
+// instanceName 事件的來源及 log 的 instance 欄位 , 依序為 Instance 的 Name , Bind , HTTPListen 或 ExecPath
+func (m *Manager) instanceName() string {
+	for _, s := range []string{m.instance.Name, m.instance.Bind, m.instance.HTTPListen} {
+		if s != "" {
+			return s
+		}
+	}
+	return m.instance.ExecPath
+}
+
+// logger 返回帶有 instance 及 exec 欄位的 log entry
+func (m *Manager) logger() *log.Entry {
+	return log.WithFields(log.Fields{"instance": m.instanceName(), "exec": m.instance.ExecPath})
+}
+
+// Instance 返回建立 Manager 時的設定
+func (m *Manager) Instance() conf.Instance {
+	return m.instance
+}
+
+// Start 啟動 MaxProcesses 個 php-cgi , 任何一個無法啟動時 , 已經啟動的都會被終止
+// warmup 失敗的 php-cgi 不算啟動失敗 , 會在背景重新啟動
+func (m *Manager) Start() error {
+	m.mutex.Lock()
+	if m.running {
+		m.mutex.Unlock()
+		return ErrAlreadyRunning
+	}
+	m.running = true
+	m.idle = list.New()
+	m.processes = nil
+	m.done = make(chan struct{})
+	m.idleCh = make(chan struct{})
+	m.mutex.Unlock()
+
+	m.logger().Info("phpfpm starting.")
+	for j := 0; j < m.instance.MaxProcesses; j++ {
+		p := newProcess(m)
+		if err := p.start(); err != nil {
+			m.Stop()
+			return err
+		}
+		m.mutex.Lock()
+		if !p.unhealthy {
+			m.pushIdle(p)
+		}
+		m.processes = append(m.processes, p)
+		m.mutex.Unlock()
+		go m.monProcess(p)
+	}
+	if m.instance.MaxMemoryPerProcess > 0 {
+		go m.monMemory(m.done)
+	}
+	m.logger().Info("phpfpm is in loop.")
+	return nil
 }
 
 // monProcess 監控 php-cgi 狀態是否跳出
-func monProcess(p *Process) {
-	log.Infof("Starting monitor php-cgi(%s)", p.ExecWithPippedName())
-	defer log.Infof("Stopped monitor php-cgi(%s)", p.ExecWithPippedName())
+func (m *Manager) monProcess(p *Process) {
+	p.logger().Info("Starting monitor php-cgi")
+	defer func() { p.logger().Info("Stopped monitor php-cgi") }()
 	for {
 		err := p.cmd.Wait()
-		if p.requestCount >= phpfpmConf.Instances[p.instanceIndex].MaxRequestsPerProcess {
-			err = p.TryStart()
-			if err != nil {
-				p.restartChan <- false
-			} else {
-				p.restartChan <- true
+		m.mutex.Lock()
+		recycling := p.recycling
+		stopped := p.stopped
+		m.mutex.Unlock()
+		if recycling {
+			// Release 要求的重新啟動 , 此時 p 不在 idle , 不需要持有 mutex
+			err = p.start()
+			m.mutex.Lock()
+			p.recycling = false
+			m.mutex.Unlock()
+			if err == nil && !p.unhealthy {
+				atomic.AddUint64(&m.restarts, 1)
 			}
-
+			p.restartChan <- err == nil && !p.unhealthy
 			continue
 		}
-		if err != nil {
-			log.Errorf("php-cgi(%s) exit error, because %s", p.ExecWithPippedName(), err.Error())
+		if p.unhealthy {
+			// warmup 失敗而被終止的 , 延遲後才重新啟動 , 避免不斷重啟
+			time.Sleep(unhealthyRestartDelay)
+		} else if err != nil && !stopped {
+			p.logger().WithError(err).Error("php-cgi exit error")
+			m.publish(hook.ProcessCrashed, p, "php-cgi(%s) exit error , because %s", p.ExecWithPippedName(), err.Error())
 		}
 
-		mutex.Lock()
+		m.mutex.Lock()
 
-		if stopManage {
-			// 執行 phpfpm.Stop() 代表不需要再監控了
-			mutex.Unlock()
+		if p.stopped {
+			// 執行 Stop() 代表不需要再監控了
+			// 不在 idle 中的 (如 unhealthy) 不會被 Stop() 清除 socket
+			removePipe(p.pippedName)
+			m.mutex.Unlock()
 			return
 		}
 
-		idleProcesses[p.instanceIndex].Remove(p.mapElement)
-		err = p.TryStart()
+		if p.mapElement != nil {
+			m.idle.Remove(p.mapElement)
+			p.mapElement = nil
+		}
+		// 啟動及 warmup 可能需要數秒 , 期間不持有 mutex , 其他 php-cgi 仍可以被取得
+		p.restarting = true
+		m.mutex.Unlock()
+		err = p.start()
+		m.mutex.Lock()
+		p.restarting = false
 
+		if p.stopped {
+			// 重新啟動期間呼叫了 Stop()
+			if err == nil {
+				p.Kill()
+				p.cmd.Wait()
+			}
+			removePipe(p.pippedName)
+			if !m.running {
+				removePipeDir(m.id)
+			}
+			m.mutex.Unlock()
+			return
+		}
 		if err != nil {
 			// 退出監控
-			log.Errorf("php-cgi(%s) restart error, because %s", p.ExecWithPippedName(), err.Error())
-			mutex.Unlock()
+			p.logger().WithError(err).Error("php-cgi restart error")
+			m.publish(hook.RestartFailed, nil, "php-cgi(%s) restart error , because %s", p.ExecWithPippedName(), err.Error())
+			m.mutex.Unlock()
 			return
 		}
-		// 啟動成功
-		p.mapElement = idleProcesses[p.instanceIndex].PushBack(p)
-		mutex.Unlock()
+		if p.unhealthy {
+			// 不放進 idle , 等待下一次重新啟動
+			m.mutex.Unlock()
+			continue
+		}
+		atomic.AddUint64(&m.restarts, 1)
+		// 啟動成功 , 處理中的 php-cgi 由 Release 放回 idle
+		if !p.busy {
+			m.pushIdle(p)
+		}
+		m.mutex.Unlock()
 		if log.IsLevelEnabled(log.InfoLevel) {
-			log.Infof("php-cgi(%s) restart successfully.", p.ExecWithPippedName())
+			p.logger().Info("php-cgi restart successfully.")
 		}
 	}
 }
 
-// Stop php-cgi manager , 所有的 process kill
-func Stop() {
-	log.Info("phpfpm stoping.")
-	stopManage = true
-	mutex.Lock()
-	defer mutex.Unlock()
+// monMemory 定期取樣 php-cgi 的記憶體用量 , done 關閉時結束
+// 超過 MaxMemoryPerProcess 的 php-cgi 會在下次 Release 時重新啟動
+func (m *Manager) monMemory(done chan struct{}) {
+	type sample struct {
+		p      *Process
+		pid    int
+		logger *log.Entry
+		rss    uint64
+		err    error
+	}
+	ticker := time.NewTicker(memorySampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		// p.cmd 只會在持有 mutex 時被替換 , 所以先在 mutex 內取得 pid
+		m.mutex.Lock()
+		var samples []sample
+		for _, p := range m.processes {
+			// 重新啟動中的 php-cgi , p.cmd 會在 mutex 外被替換
+			if !p.recycling && !p.restarting && p.cmd != nil && p.cmd.Process != nil {
+				samples = append(samples, sample{p: p, pid: p.cmd.Process.Pid, logger: p.logger()})
+			}
+		}
+		m.mutex.Unlock()
 
-	var next *list.Element
+		for i := range samples {
+			samples[i].rss, samples[i].err = processRSS(samples[i].pid)
+		}
 
-	for _, v := range idleProcesses {
-		for e := v.Front(); e != nil; e = next {
-			next = e.Next()
-			p := e.Value.(*Process)
-			p.Kill()
-			v.Remove(e)
+		m.mutex.Lock()
+		for _, s := range samples {
+			if s.err != nil {
+				// 行程可能剛好結束 , 下次再取樣
+				s.logger.WithError(s.err).Debug("php-cgi can not read memory usage")
+				continue
+			}
+			// 取樣期間重新啟動過的 php-cgi , 結果不屬於新的行程
+			if !s.p.recycling && !s.p.restarting && s.p.cmd != nil && s.p.cmd.Process != nil && s.p.cmd.Process.Pid == s.pid {
+				s.p.rss = s.rss
+			}
 		}
+		m.mutex.Unlock()
+	}
+}
+
+// Stop 終止所有的 php-cgi , 處理中的要求也會中斷 , 應該先等待處理中的要求結束
+func (m *Manager) Stop() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.running {
+		return
+	}
+	m.logger().Info("phpfpm stoping.")
+	m.running = false
+	close(m.done)
+	m.notifyIdle()
 
+	for _, p := range m.processes {
+		p.stopped = true
+		if p.mapElement != nil {
+			m.idle.Remove(p.mapElement)
+			p.mapElement = nil
+		}
+		// unhealthy 的已經結束 , 重新啟動中的由 Release 或 monProcess 處理
+		if !p.recycling && !p.restarting && !p.unhealthy {
+			p.Kill()
+			removePipe(p.pippedName)
+		}
 	}
-	log.Info("phpfpm stopped.")
+	removePipeDir(m.id)
+	m.logger().Info("phpfpm stopped.")
 }
 
-// GetIdleProcess : 取得任何一個 Idle 的 Process , 並且移除 Idle 列表
-func GetIdleProcess(instanceIndex int) (p *Process) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	e := idleProcesses[instanceIndex].Front()
+// Acquire 取得一個 idle 的 php-cgi , 並且移除 idle 列表 , 沒有 idle 的 php-cgi 時返回 nil
+// 使用完畢後必須呼叫 Release
+func (m *Manager) Acquire() (p *Process) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.running || m.idle.Len() == 0 {
+		return
+	}
+	e := m.selector(m.idle)
 	if e != nil {
-		p = idleProcesses[instanceIndex].Remove(e).(*Process)
+		p = m.idle.Remove(e).(*Process)
 		p.mapElement = nil
+		p.busy = true
 	}
 	return
 }
 
-// PutIdleProcess : 設定 Process 為 idle
-func PutIdleProcess(p *Process) (err error) {
+// Release 將 Acquire 取得的 php-cgi 設定為 idle
+// 需要重新啟動時 , 等待重新啟動的期間不會持有 mutex , 其他 php-cgi 仍可以被取得
+func (m *Manager) Release(p *Process) (err error) {
 
-	mutex.Lock()
-	defer mutex.Unlock()
+	m.mutex.Lock()
 	if p.pipe != nil {
 		err = p.pipe.Close()
 		p.pipe = nil
 	}
+	if p.stopped || p.restarting {
+		// Stop() 已經終止了這個 php-cgi , 或 php-cgi 異常結束 , monProcess 重新啟動後會放回 idle
+		p.busy = false
+		m.mutex.Unlock()
+		return
+	}
 
-	if p.requestCount >= phpfpmConf.Instances[p.instanceIndex].MaxRequestsPerProcess {
-		log.Warnf("php-cgi(%s) handled %d requests , need restart.", p.execWithPippedName, p.requestCount)
-		p.Kill()
-		if true == <-p.restartChan {
-			p.mapElement = idleProcesses[p.instanceIndex].PushBack(p)
-		} else {
-			log.Errorf("php-cgi(%s) restart faild.", p.execWithPippedName)
-		}
-	} else {
-		p.mapElement = idleProcesses[p.instanceIndex].PushBack(p)
+	reason := p.recycleReason()
+	if reason == "" {
+		p.busy = false
+		m.pushIdle(p)
 		if log.IsLevelEnabled(log.DebugLevel) {
-			log.Debugf("php-cgi(%s) is idle , requests count : %d", p.execWithPippedName, p.requestCount)
+			p.requestLogger().Debug("php-cgi is idle")
 		}
+		m.mutex.Unlock()
+		return
+	}
+
+	p.requestLogger().WithField("reason", reason).Warn("php-cgi need restart.")
+	// monProcess 在 mutex 內讀取 recycling , 所以 php-cgi 已經先結束也不會漏掉
+	p.recycling = true
+	m.mutex.Unlock()
+	p.Kill()
+	restarted := <-p.restartChan
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	p.busy = false
+	if !restarted {
+		if p.unhealthy {
+			// warmup 失敗 , start 已經送出 ProcessUnhealthy , monProcess 延遲後會再重新啟動
+			return
+		}
+		p.logger().Error("php-cgi restart failed.")
+		m.publish(hook.RestartFailed, nil, "php-cgi(%s) restart failed after %s", p.execWithPippedName, reason)
+		return
+	}
+	if p.stopped {
+		// 重新啟動期間呼叫了 Stop()
+		p.Kill()
+		removePipe(p.pippedName)
+		return
 	}
+	m.pushIdle(p)
 	return
 }
+
+// pushIdle 將 p 放進 idle 並通知等待中的 Dial , 必須持有 mutex
+func (m *Manager) pushIdle(p *Process) {
+	p.mapElement = m.idle.PushBack(p)
+	m.notifyIdle()
+}
+
+// notifyIdle 喚醒所有等待 idleCh 的 goroutine , 必須持有 mutex
+func (m *Manager) notifyIdle() {
+	close(m.idleCh)
+	m.idleCh = make(chan struct{})
+}
+
+// Stats 返回 Manager 目前的狀態
+func (m *Manager) Stats() Stats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	stats := Stats{
+		Processes:      len(m.processes),
+		Restarts:       atomic.LoadUint64(&m.restarts),
+		ConnectRetries: atomic.LoadUint64(&m.connectRetries),
+		RateLimited:    atomic.LoadUint64(&m.rateLimited),
+		RateQueued:     atomic.LoadUint64(&m.rateQueued),
+	}
+	if m.idle != nil {
+		stats.Idle = m.idle.Len()
+	}
+	for _, p := range m.processes {
+		if p.busy || p.restarting {
+			stats.Busy++
+		} else if p.unhealthy {
+			stats.Unhealthy++
+		}
+	}
+	return stats
+}
@@ -0,0 +1,56 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// pipeDir 返回 Manager 存放 socket 的目錄 , 每個 Manager 有自己的目錄
+// 目錄名稱包含 pid , 避免升級時新舊兩個 wphpfpm 的 socket 名稱重複
+func pipeDir(managerID int) string {
+	return filepath.Join(os.TempDir(), "wphpfpm."+strconv.Itoa(os.Getpid()), strconv.Itoa(managerID))
+}
+
+// pipeName 返回 php-cgi -b 使用的 unix socket 路徑
+func pipeName(managerID int, number int64) string {
+	return filepath.Join(pipeDir(managerID), "php-cgi."+strconv.FormatInt(number, 10)+".sock")
+}
+
+// preparePipe 建立 socket 所在的目錄
+// Instance 的目錄只有 php-cgi 的執行身分 (及 root) 可以存取 , 上層目錄只允許穿越
+func preparePipe(name string, cred *credential) error {
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(filepath.Dir(dir), 0711); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if cred != nil {
+		return os.Chown(dir, int(cred.Uid), int(cred.Gid))
+	}
+	return nil
+}
+
+// removePipe 移除 php-cgi 結束後留下的 socket 檔案
+func removePipe(name string) {
+	os.Remove(name)
+}
+
+// removePipeDir 移除 Manager 的 socket 目錄 , 最後一個 Manager 也會移除上層目錄
+func removePipeDir(managerID int) {
+	dir := pipeDir(managerID)
+	os.RemoveAll(dir)
+	// 還有其他 Manager 的目錄時會失敗
+	os.Remove(filepath.Dir(dir))
+}
+
+// dialPipe 連接 php-cgi 的 unix socket
+func dialPipe(name string) (net.Conn, error) {
+	return net.Dial("unix", name)
+}
@@ -0,0 +1,31 @@
+package phpfpm
+
+import (
+	"net"
+	"strconv"
+
+	"gopkg.in/natefinch/npipe.v2"
+)
+
+// pipeName 返回 php-cgi -b 使用的 windows named pipe 名稱
+func pipeName(managerID int, number int64) string {
+	return `\\.\pipe\wphpfpm\wphpfpm.` + strconv.FormatInt(number, 10)
+}
+
+// preparePipe named pipe 不需要事先準備
+func preparePipe(name string, cred *credential) error {
+	return nil
+}
+
+// removePipe named pipe 在 php-cgi 結束後就不存在了 , 不需要移除
+func removePipe(name string) {
+}
+
+// removePipeDir named pipe 沒有目錄
+func removePipeDir(managerID int) {
+}
+
+// dialPipe 連接 php-cgi 的 named pipe
+func dialPipe(name string) (net.Conn, error) {
+	return npipe.Dial(name)
+}
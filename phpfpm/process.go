@@ -2,30 +2,39 @@ package phpfpm
 
 import (
 	"container/list"
+	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
-	"strconv"
 	"sync"
 	"time"
+	"wphpfpm/hook"
 
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/natefinch/npipe.v2"
 )
 
 // Process : struct
 type Process struct {
-	execPath      string
-	args          []string
-	env           []string
-	cmd           *exec.Cmd
-	instanceIndex int // 這個是在 phpfpm.go 中的 idleprocess  連結用的 , 代表這個 Process 是屬於那個 Instance
-	mapElement    *list.Element
-	pipe          *npipe.PipeConn
-	pippedName    string // php-cgi 執行時指定的 pipped name
+	execPath   string
+	args       []string
+	env        []string
+	cmd        *exec.Cmd
+	m          *Manager // 這個 Process 所屬的 Manager
+	mapElement *list.Element
+	pipe       net.Conn // windows 為 named pipe , 其他平台為 unix socket
+	pippedName string   // php-cgi 執行時指定的 pipped name
 
-	requestCount int // 紀錄當前執行中的 php-cgi 已經接受幾次要求了
+	requestCount  int       // 紀錄當前執行中的 php-cgi 已經接受幾次要求了
+	startTime     time.Time // 當前執行中的 php-cgi 啟動的時間
+	rss           uint64    // 最近一次取樣的記憶體用量 (byte) , 持有 mutex 時才能存取
+	recycling     bool      // Release 準備重新啟動時設為 true , 讓 monProcess 知道不是異常結束 , 持有 mutex 時才能存取
+	restarting    bool      // monProcess 在 mutex 外重新啟動異常結束的 php-cgi , 此時 cmd 等欄位會被替換 , 持有 mutex 時才能存取
+	busy          bool      // 被 Acquire 取走 , 還沒有 Release , 持有 mutex 時才能存取
+	connectFailed bool      // 連線 php-cgi 失敗 , Release 時重新啟動
+
+	unhealthy bool // warmup 失敗 , 已經被終止 , monProcess 延遲後才會重新啟動
+	stopped   bool // Manager.Stop() 之後為 true , monProcess 不再重新啟動 , 持有 mutex 時才能存取
 
 	restartChan chan bool
 
@@ -42,12 +51,13 @@ var (
 )
 
 // newProcess : Create new Process
-// 建立一個新的 Process
-func newProcess(execPath string, args []string, env []string) *Process {
+// 建立一個屬於 m 的 Process
+func newProcess(m *Manager) *Process {
 	p := new(Process)
-	p.execPath = execPath
-	p.args = args
-	p.env = env
+	p.m = m
+	p.execPath = m.instance.ExecPath
+	p.args = m.instance.Args
+	p.env = m.instance.Env
 	p.restartChan = make(chan bool)
 	p.copyRbuf = make([]byte, 4096)
 	p.copyWbuf = make([]byte, 16384)
@@ -59,33 +69,89 @@ func (p *Process) TryStart() (err error) {
 	// pippedName 是啟動 php-cgi 時候指定 -b pipename 使用的
 	namedPipeNumberMutex.Lock()
 	namedPipeNumber++
+	number := namedPipeNumber
 	namedPipeNumberMutex.Unlock()
-	p.pippedName = `\\.\pipe\wphpfpm\wphpfpm.` + strconv.FormatInt(namedPipeNumber, 10)
+	if p.pippedName != "" {
+		// 上一次執行留下來的 socket 檔案
+		removePipe(p.pippedName)
+	}
+	p.pippedName = pipeName(p.m.id, number)
+	if err = preparePipe(p.pippedName, p.m.cred); err != nil {
+		p.logger().WithError(err).Error("php-cgi can not prepare pipe")
+		return
+	}
 	p.requestCount = 0
+	p.rss = 0
+	p.connectFailed = false
 	p.execWithPippedName = p.execPath + " -> " + p.pippedName
+	p.cmd = nil // 已經結束的行程 , log 不帶舊的 pid
 
-	log.Debugf("Trying to start php-cgi(%s).", p.execWithPippedName)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		p.logger().Debug("Trying to start php-cgi.")
+	}
 	for i := 0; i < 2; i++ {
-		args := append(p.args, "-b", p.pippedName)
+		args := make([]string, 0, len(p.args)+len(p.m.iniArgs)+2)
+		args = append(args, p.args...)
+		args = append(args, p.m.iniArgs...)
+		args = append(args, "-b", p.pippedName)
 		p.cmd = nil
 		p.cmd = exec.Command(p.execPath, args...)
 		p.cmd.Env = os.Environ()
 		p.cmd.Env = append(p.cmd.Env, p.env...)
-		err = p.cmd.Start()
+		if p.m.instance.Limits != nil {
+			err = startWithLimits(p.cmd, p.m.instance.Limits, p.m.cred)
+		} else {
+			setCredential(p.cmd, p.m.cred)
+			err = p.cmd.Start()
+		}
 		if err == nil {
 			i = 3
+			p.startTime = time.Now()
 			if log.IsLevelEnabled(log.DebugLevel) {
-				log.Debugf("php-cgi(%s) executing now.", p.execWithPippedName)
+				p.logger().Debug("php-cgi executing now.")
 			}
 		}
 	}
 
+	if err == nil {
+		// php-cgi 建立 pipe 之前連線會失敗 , 確認可以連線後才能放進 idleProcesses
+		if err = waitReady(p.pippedName, p.m.startupTimeout); err != nil {
+			p.cmd.Process.Kill()
+			p.cmd.Wait()
+		} else if log.IsLevelEnabled(log.DebugLevel) {
+			p.logger().Debug("php-cgi is ready.")
+		}
+	}
+
 	if err != nil {
-		log.Errorf("php-cgi(%s) can not start , because %s", p.execWithPippedName, err.Error())
+		p.logger().WithError(err).Error("php-cgi can not start")
 	}
 	return
 }
 
+// start 啟動 php-cgi 並執行 warmup , 成功後才能放進 idleProcesses
+// warmup 失敗時 php-cgi 會被終止並標記為 unhealthy , 返回值仍是 nil , 由呼叫者檢查 p.unhealthy
+func (p *Process) start() error {
+	p.unhealthy = false
+	if err := p.TryStart(); err != nil {
+		return err
+	}
+	if len(p.m.instance.Warmup) == 0 {
+		return nil
+	}
+	if err := p.warmup(); err != nil {
+		p.logger().WithError(err).Error("php-cgi warmup failed , marked unhealthy")
+		p.m.publish(hook.ProcessUnhealthy, p, "php-cgi(%s) warmup failed , because %s", p.execWithPippedName, err.Error())
+		p.unhealthy = true
+		p.Kill()
+		return nil
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		p.logger().Debug("php-cgi warmup completed.")
+	}
+	return nil
+}
+
 // connectPipe will connect to php-cgi named pipe
 func (p *Process) connectPipe() error {
 	var err error
@@ -93,65 +159,128 @@ func (p *Process) connectPipe() error {
 	//		p.pipe.Close()
 	//}
 
-	p.pipe, err = npipe.Dial(p.pippedName)
+	p.pipe, err = dialPipe(p.pippedName)
 	if err != nil {
-		log.Errorf("Connect to php-cgi(%s) error , because %s", p.execWithPippedName, err.Error())
+		p.requestLogger().WithError(err).Error("Connect to php-cgi error")
 		return err
 	}
 	p.requestCount++
 	if log.IsLevelEnabled(log.DebugLevel) {
-		log.Debugf("Connect to php-cgi(%s) successfully.", p.execWithPippedName)
+		p.requestLogger().Debug("Connect to php-cgi successfully.")
 	}
 
 	return nil
 }
 
-// Proxy net.Conn <> Windows-named-pipe
-// Proxy 將 tcp 來源跟 windows named pipe 直接做讀寫
+// ConnectError 連線 php-cgi 失敗 , 此時還沒有送出任何資料給 php-cgi , 可以換另一個 php-cgi 重試
+type ConnectError struct {
+	Err error
+}
+
+func (e *ConnectError) Error() string {
+	return "connect to php-cgi error , " + e.Err.Error()
+}
+
+// Proxy net.Conn <> Windows-named-pipe (或 unix socket)
+// Proxy 將 tcp 來源跟 windows named pipe (或 unix socket) 直接做讀寫
 // 返回值 serr 代表由 http server 讀取資料寫至 php-cgi 的錯誤
-// 返回值 terr 代表由 php-cgi 讀取資料寫至 http server 的錯誤
+// 返回值 terr 代表由 php-cgi 讀取資料寫至 http server 的錯誤 , 無法連線 php-cgi 時為 *ConnectError
 func (p *Process) Proxy(conn net.Conn) (serr error, terr error) {
 
-	terr = p.connectPipe()
-	if terr != nil {
+	if err := p.connectPipe(); err != nil {
+		p.connectFailed = true
+		terr = &ConnectError{Err: err}
 		return
 	}
+	return p.proxy(conn)
+}
 
+// proxy 同 Proxy , 但 p.pipe 已經由 connectPipe 連線
+func (p *Process) proxy(conn net.Conn) (serr error, terr error) {
+	pipe := p.pipe
 	p.wg.Add(2)
 	go func() {
 		// read from web server , write to php-cgi
-		_, serr = io.CopyBuffer(p.pipe, conn, p.copyRbuf)
+		_, serr = io.CopyBuffer(pipe, conn, p.copyRbuf)
+		if serr != nil {
+			// 如 IdleTimeout , 中斷 php-cgi 端 , 避免另一個方向一直等待 php-cgi 輸出
+			pipe.Close()
+		}
 		p.wg.Done()
 	}()
 	go func() {
 		// read from php-cgi , write to web server
-		_, terr = io.CopyBuffer(conn, p.pipe, p.copyWbuf)
+		_, terr = io.CopyBuffer(conn, pipe, p.copyWbuf)
+		// 錯誤 (如 WriteTimeout) 或 php-cgi 已經關閉連線 , 這個連線上不會再有回應
+		// 中斷 web server 端 , 避免另一個方向一直等待 , 或 keep-alive 的 client 在同一個連線送出下一個要求
+		conn.Close()
 		p.wg.Done()
 	}()
 
 	p.wg.Wait()
-	p.pipe.Close()
+	pipe.Close()
 	p.pipe = nil
 	return
 }
 
+// recycleReason 返回需要重新啟動的原因 , 不需要時返回空字串
+func (p *Process) recycleReason() string {
+	instance := p.m.instance
+	if p.connectFailed {
+		return "can not be connected"
+	}
+	if p.requestCount >= instance.MaxRequestsPerProcess {
+		return fmt.Sprintf("handled %d requests", p.requestCount)
+	}
+	if instance.MaxProcessLifetime > 0 {
+		if lifetime := time.Since(p.startTime); lifetime >= time.Duration(instance.MaxProcessLifetime)*time.Second {
+			return fmt.Sprintf("has run for %s", lifetime.Truncate(time.Second))
+		}
+	}
+	if instance.MaxMemoryPerProcess > 0 {
+		if rss := p.rss; rss > uint64(instance.MaxMemoryPerProcess)*1024*1024 {
+			return fmt.Sprintf("uses %d MB memory", rss/1024/1024)
+		}
+	}
+	return ""
+}
+
 // Kill php-cgi process
+// 重新啟動失敗 (cmd.Start 返回錯誤) 的 Process 沒有行程 , 不需要終止
 func (p *Process) Kill() (err error) {
+	if p.cmd == nil || p.cmd.Process == nil {
+		return nil
+	}
 	err = p.cmd.Process.Kill()
 
 	if err != nil {
 		if log.IsLevelEnabled(log.ErrorLevel) {
-			log.Errorf("Kill php-cgi(%s) error , because %s", p.execWithPippedName, err.Error())
+			p.logger().WithError(err).Error("Kill php-cgi error")
 		}
 	} else {
 		if log.IsLevelEnabled(log.DebugLevel) {
-			log.Debugf("Kill php-cgi(%s) successfully.", p.execWithPippedName)
+			p.logger().Debug("Kill php-cgi successfully.")
 		}
 	}
 
 	return
 }
 
+// logger 返回帶有 instance , pid 及 pipe 欄位的 log entry
+// requestCount 在處理要求時會被修改 , 只有取得這個 php-cgi 的呼叫者才能以 requestLogger 記錄
+func (p *Process) logger() *log.Entry {
+	fields := log.Fields{"instance": p.m.instanceName(), "pipe": p.pippedName}
+	if p.cmd != nil && p.cmd.Process != nil {
+		fields["pid"] = p.cmd.Process.Pid
+	}
+	return log.WithFields(fields)
+}
+
+// requestLogger 同 logger , 加上 requests 欄位 , 只能由 Acquire 取得這個 php-cgi 的呼叫者使用
+func (p *Process) requestLogger() *log.Entry {
+	return p.logger().WithField("requests", p.requestCount)
+}
+
 // ExecWithPippedName ...
 func (p *Process) ExecWithPippedName() string {
 	return p.execWithPippedName
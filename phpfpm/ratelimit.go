@@ -0,0 +1,124 @@
+package phpfpm
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"wphpfpm/conf"
+	"wphpfpm/hook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rateLimitLogInterval 同一個 Manager 記錄超過 RateLimit 訊息的最短間隔
+const rateLimitLogInterval = time.Second
+
+// ErrRateLimited 超過 RateLimit , 要求被拒絕
+var ErrRateLimited = errors.New("php-cgi request rate limit exceeded")
+
+// rateLimiter token bucket , 每秒補充 rate 個 token , 最多累積 burst 個
+// queue 模式下 tokens 可以是負數 , 代表已經預約給等待中的要求
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time // 最後一次補充 token 的時間
+	queue  bool
+	logged time.Time // 最後一次記錄訊息的時間
+}
+
+// newRateLimiter 依據 instance 的 RateLimit 建立 rateLimiter , 沒有設定時返回 nil
+func newRateLimiter(instance conf.Instance) *rateLimiter {
+	if instance.RateLimit <= 0 {
+		return nil
+	}
+	burst := float64(instance.RateBurst)
+	if burst < 1 {
+		burst = math.Ceil(instance.RateLimit)
+	}
+	return &rateLimiter{
+		rate:   instance.RateLimit,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+		queue:  instance.RateLimitMode == "queue",
+	}
+}
+
+// take 在 now 取得一個 token , 返回取得前需要等待的時間
+// reject 模式沒有 token 時 ok 為 false , queue 模式一定成功 , 等待的時間依前面預約的數量而定
+func (l *rateLimiter) take(now time.Time) (wait time.Duration, ok bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0, true
+	}
+	if !l.queue {
+		return 0, false
+	}
+	l.tokens--
+	return time.Duration(-l.tokens / l.rate * float64(time.Second)), true
+}
+
+// cancel 退回 queue 模式預約但沒有使用的 token
+func (l *rateLimiter) cancel() {
+	l.mutex.Lock()
+	l.tokens = math.Min(l.burst, l.tokens+1)
+	l.mutex.Unlock()
+}
+
+// shouldLog 距離上次記錄超過 rateLimitLogInterval 時返回 true
+func (l *rateLimiter) shouldLog(now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if now.Sub(l.logged) < rateLimitLogInterval {
+		return false
+	}
+	l.logged = now
+	return true
+}
+
+// waitRate 依 RateLimit 取得處理要求的 token , 沒有設定 RateLimit 時直接返回 nil
+// reject 模式超過時返回 ErrRateLimited , queue 模式等待到取得 token , ctx 先結束時返回 ctx.Err()
+func (m *Manager) waitRate(ctx context.Context) error {
+	l := m.limiter
+	if l == nil {
+		return nil
+	}
+	now := time.Now()
+	wait, ok := l.take(now)
+	if !ok {
+		count := atomic.AddUint64(&m.rateLimited, 1)
+		if log.IsLevelEnabled(log.WarnLevel) && l.shouldLog(now) {
+			m.logger().WithField("rejected", count).Warnf("Request rate exceeds RateLimit %g/s , rejected", l.rate)
+		}
+		m.publish(hook.RateLimited, nil, "request rate exceeds RateLimit %g/s , rejected", l.rate)
+		return ErrRateLimited
+	}
+	if wait <= 0 {
+		return nil
+	}
+	count := atomic.AddUint64(&m.rateQueued, 1)
+	if log.IsLevelEnabled(log.WarnLevel) && l.shouldLog(now) {
+		m.logger().WithField("queued", count).Warnf("Request rate exceeds RateLimit %g/s , queued for %s", l.rate, wait.Truncate(time.Millisecond))
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,72 @@
+package phpfpm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"wphpfpm/conf"
+)
+
+func TestRateLimiterReject(t *testing.T) {
+	l := newRateLimiter(conf.Instance{RateLimit: 2, RateBurst: 2})
+	now := l.last
+	for i := 0; i < 2; i++ {
+		if _, ok := l.take(now); !ok {
+			t.Fatalf("request #%d should be allowed within burst", i)
+		}
+	}
+	if _, ok := l.take(now); ok {
+		t.Error("request should be rejected after burst")
+	}
+	// 每秒補充 2 個 token
+	if _, ok := l.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Error("request should be allowed after refill")
+	}
+	if newRateLimiter(conf.Instance{}) != nil {
+		t.Error("rateLimiter should be nil without RateLimit")
+	}
+}
+
+func TestRateLimiterQueue(t *testing.T) {
+	l := newRateLimiter(conf.Instance{RateLimit: 10, RateLimitMode: "queue"})
+	if l.burst != 10 {
+		t.Errorf("default burst should be 10 , got %g", l.burst)
+	}
+	now := l.last
+	for i := 0; i < 10; i++ {
+		l.take(now)
+	}
+	for i, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond} {
+		wait, ok := l.take(now)
+		if !ok || wait != expected {
+			t.Errorf("queued request #%d : expected wait %s , got %s (%v)", i, expected, wait, ok)
+		}
+	}
+	l.cancel()
+	if wait, _ := l.take(now); wait != 200*time.Millisecond {
+		t.Errorf("cancelled reservation should be returned , got wait %s", wait)
+	}
+}
+
+func TestWaitRate(t *testing.T) {
+	m := &Manager{limiter: newRateLimiter(conf.Instance{RateLimit: 1})}
+	if err := m.waitRate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.waitRate(context.Background()); err != ErrRateLimited {
+		t.Errorf("expected ErrRateLimited , got %v", err)
+	}
+
+	m = &Manager{limiter: newRateLimiter(conf.Instance{RateLimit: 1, RateLimitMode: "queue"})}
+	m.waitRate(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := m.waitRate(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded , got %v", err)
+	}
+	stats := m.Stats()
+	if stats.RateLimited != 0 || stats.RateQueued != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,36 @@
+package phpfpm
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultStartupTimeout Instance 沒有設定 StartupTimeout 時的預設值
+	defaultStartupTimeout = 10 * time.Second
+	// readyMinBackoff , readyMaxBackoff 等待 php-cgi 開始 listen 時 , 重試間隔的範圍
+	readyMinBackoff = 10 * time.Millisecond
+	readyMaxBackoff = 500 * time.Millisecond
+)
+
+// waitReady 持續連線 php-cgi 的 pipe (或 unix socket) 直到成功 , 每次失敗重試的間隔加倍
+// php-cgi 在 timeout 內都無法連線時返回錯誤
+func waitReady(name string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := readyMinBackoff
+	for {
+		conn, err := dialPipe(name)
+		if err == nil {
+			// 只確認可以連線 , 沒有送出任何要求
+			conn.Close()
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("not ready after %s , last error : %s", timeout, err.Error())
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > readyMaxBackoff {
+			backoff = readyMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+)
+
+// pidOf 返回 php-cgi 目前的 pid
+func pidOf(m *Manager, p *Process) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return p.cmd.Process.Pid
+}
+
+// reasonOf 在 mutex 內返回 recycleReason
+func reasonOf(m *Manager, p *Process) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return p.recycleReason()
+}
+
+func TestRecycleMaxProcessLifetime(t *testing.T) {
+	m := newTestManager(t, conf.Instance{MaxProcesses: 1, MaxProcessLifetime: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	p := m.Acquire()
+	pid := pidOf(m, p)
+	if reason := reasonOf(m, p); reason != "" {
+		t.Errorf("new php-cgi should not be recycled : %s", reason)
+	}
+	m.Release(p)
+	if p = m.Acquire(); pidOf(m, p) != pid {
+		t.Error("php-cgi is restarted before MaxProcessLifetime")
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+	if reason := reasonOf(m, p); !strings.HasPrefix(reason, "has run for") {
+		t.Errorf("unexpected reason %q", reason)
+	}
+	// Release 時重新啟動
+	m.Release(p)
+	if p = m.Acquire(); pidOf(m, p) == pid {
+		t.Error("php-cgi is not restarted after MaxProcessLifetime")
+	}
+	if reason := reasonOf(m, p); reason != "" {
+		t.Errorf("restarted php-cgi should not be recycled : %s", reason)
+	}
+	m.Release(p)
+}
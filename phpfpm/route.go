@@ -0,0 +1,65 @@
+package phpfpm
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"wphpfpm/conf"
+)
+
+// route : Instance 名稱已經轉換為 Manager 的 conf.Route
+type route struct {
+	param  string
+	equals string
+	prefix string
+	target *Manager
+}
+
+// Router 依 FastCGI params 選擇處理要求的 Manager
+type Router struct {
+	routes []route
+}
+
+// NewRouter 建立 Router , managers 以 Instance 的 Name 為 key
+func NewRouter(routes []conf.Route, managers map[string]*Manager) (*Router, error) {
+	r := &Router{routes: make([]route, len(routes))}
+	for i, v := range routes {
+		target, ok := managers[v.Instance]
+		if !ok {
+			return nil, fmt.Errorf("route instance %s is not found", v.Instance)
+		}
+		r.routes[i] = route{param: v.Param, equals: v.Equals, prefix: v.Prefix, target: target}
+	}
+	return r, nil
+}
+
+// Route 依序比對規則 , 返回第一個符合的 Manager , 都不符合時返回 nil
+func (r *Router) Route(params map[string]string) *Manager {
+	for _, v := range r.routes {
+		value, ok := params[v.param]
+		if !ok {
+			continue
+		}
+		if (v.equals != "" && value == v.equals) || (v.prefix != "" && strings.HasPrefix(value, v.prefix)) {
+			return v.target
+		}
+	}
+	return nil
+}
+
+// replayConn 先讀出已經被讀走的 head , 再繼續讀取原本的連線
+type replayConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *replayConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// NewReplayConn 返回一個 net.Conn , 讀取時會先讀到 head , 之後才是 conn 本身的資料
+func NewReplayConn(conn net.Conn, head []byte) net.Conn {
+	return &replayConn{Conn: conn, r: io.MultiReader(bytes.NewReader(head), conn)}
+}
@@ -0,0 +1,63 @@
+package phpfpm
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"wphpfpm/conf"
+)
+
+func TestRouter(t *testing.T) {
+	php7, php8 := &Manager{}, &Manager{}
+	managers := map[string]*Manager{"php7": php7, "php8": php8}
+	if _, err := NewRouter([]conf.Route{{Param: "SERVER_NAME", Equals: "a", Instance: "php9"}}, managers); err == nil {
+		t.Error("expected unknown instance error")
+	}
+
+	r, err := NewRouter([]conf.Route{
+		{Param: "SERVER_NAME", Equals: "php8.example.com", Instance: "php8"},
+		{Param: "SCRIPT_FILENAME", Prefix: "/var/www/legacy/", Instance: "php7"},
+		// 依序比對 , 前面的規則符合時 , 後面較長的 Prefix 不會被使用
+		{Param: "SCRIPT_FILENAME", Prefix: "/var/www/legacy/new/", Instance: "php8"},
+	}, managers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		params   map[string]string
+		expected *Manager
+	}{
+		{map[string]string{"SERVER_NAME": "php8.example.com"}, php8},
+		{map[string]string{"SERVER_NAME": "php8.example.com.evil"}, nil},
+		{map[string]string{"SCRIPT_FILENAME": "/var/www/legacy/index.php"}, php7},
+		{map[string]string{"SCRIPT_FILENAME": "/var/www/legacy/new/index.php"}, php7},
+		{map[string]string{"SERVER_NAME": "php8.example.com", "SCRIPT_FILENAME": "/var/www/legacy/index.php"}, php8},
+		// 都不符合時返回 nil , 由原本的 Instance 處理
+		{map[string]string{"SCRIPT_FILENAME": "/var/www/html/index.php"}, nil},
+		{map[string]string{}, nil},
+	} {
+		if m := r.Route(c.params); m != c.expected {
+			t.Errorf("Route(%v) returns the wrong instance", c.params)
+		}
+	}
+}
+
+func TestReplayConn(t *testing.T) {
+	client, server := net.Pipe()
+	go func() {
+		client.Write([]byte(" world"))
+		client.Close()
+	}()
+	conn := NewReplayConn(server, []byte("hello"))
+	defer conn.Close()
+	b, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "hello world" {
+		t.Errorf("unexpected data %q", b)
+	}
+	if conn.RemoteAddr() != server.RemoteAddr() {
+		t.Error("replayConn should keep the original connection")
+	}
+}
@@ -0,0 +1,55 @@
+package phpfpm
+
+import (
+	"container/list"
+	"math/rand"
+)
+
+// Strategy names , 對應 conf.Instance.Strategy
+const (
+	StrategyFIFO          = "fifo"
+	StrategyLIFO          = "lifo"
+	StrategyLeastRequests = "least-requests"
+	StrategyRandom        = "random"
+)
+
+// strategy 從 idle 列表中選出下一個要使用的 php-cgi , 列表不是空的才會呼叫
+// Release 經由 pushIdle 一律放到列表的最後面
+type strategy func(idle *list.List) *list.Element
+
+var strategies = map[string]strategy{
+	// fifo 使用閒置最久的 php-cgi , 負載平均分散到每個 php-cgi
+	StrategyFIFO: func(idle *list.List) *list.Element {
+		return idle.Front()
+	},
+	// lifo 使用剛閒置的 php-cgi , 讓少數 php-cgi 保持 opcache 及 realpath cache 是熱的
+	StrategyLIFO: func(idle *list.List) *list.Element {
+		return idle.Back()
+	},
+	// least-requests 使用處理次數最少的 php-cgi , 延後達到 MaxRequestsPerProcess 的時間
+	StrategyLeastRequests: func(idle *list.List) *list.Element {
+		least := idle.Front()
+		for e := least.Next(); e != nil; e = e.Next() {
+			if e.Value.(*Process).requestCount < least.Value.(*Process).requestCount {
+				least = e
+			}
+		}
+		return least
+	},
+	// random 隨機選一個
+	StrategyRandom: func(idle *list.List) *list.Element {
+		e := idle.Front()
+		for n := rand.Intn(idle.Len()); n > 0; n-- {
+			e = e.Next()
+		}
+		return e
+	},
+}
+
+// newStrategy 返回名稱對應的 strategy , 空字串為 fifo , 名稱已經在 conf.Validate 檢查過
+func newStrategy(name string) strategy {
+	if s, ok := strategies[name]; ok {
+		return s
+	}
+	return strategies[StrategyFIFO]
+}
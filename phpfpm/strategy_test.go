@@ -0,0 +1,89 @@
+package phpfpm
+
+import (
+	"container/list"
+	"testing"
+)
+
+func newIdleList(n int) *list.List {
+	idle := list.New()
+	for i := 0; i < n; i++ {
+		idle.PushBack(&Process{})
+	}
+	return idle
+}
+
+// simulate 以 concurrency 個同時處理中的要求 , 執行 n 次 Acquire / Release
+// 返回每個 php-cgi 處理的要求次數
+func simulate(s strategy, idle *list.List, concurrency int, n int) []int {
+	busy := make([]*Process, 0, concurrency)
+	for i := 0; i < n; i++ {
+		p := idle.Remove(s(idle)).(*Process)
+		p.requestCount++
+		busy = append(busy, p)
+		if len(busy) == concurrency {
+			for _, p := range busy {
+				idle.PushBack(p)
+			}
+			busy = busy[:0]
+		}
+	}
+	for _, p := range busy {
+		idle.PushBack(p)
+	}
+	counts := make([]int, 0, idle.Len())
+	for e := idle.Front(); e != nil; e = e.Next() {
+		counts = append(counts, e.Value.(*Process).requestCount)
+	}
+	return counts
+}
+
+func TestStrategies(t *testing.T) {
+	counts := simulate(newStrategy(StrategyLIFO), newIdleList(8), 2, 100)
+	used := 0
+	for _, c := range counts {
+		if c > 0 {
+			used++
+		}
+	}
+	if used != 2 {
+		t.Errorf("lifo should keep 2 hot workers , got %v", counts)
+	}
+
+	counts = simulate(newStrategy(""), newIdleList(8), 2, 80)
+	for _, c := range counts {
+		if c != 10 {
+			t.Errorf("fifo should spread requests evenly , got %v", counts)
+			break
+		}
+	}
+
+	idle := newIdleList(3)
+	idle.Front().Value.(*Process).requestCount = 5
+	idle.Back().Value.(*Process).requestCount = 7
+	if e := newStrategy(StrategyLeastRequests)(idle); e != idle.Front().Next() {
+		t.Error("least-requests should pick the worker with fewest requests")
+	}
+}
+
+func BenchmarkStrategy(b *testing.B) {
+	for _, name := range []string{StrategyFIFO, StrategyLIFO, StrategyLeastRequests, StrategyRandom} {
+		b.Run(name, func(b *testing.B) {
+			idle := newIdleList(16)
+			counts := simulate(newStrategy(name), idle, 4, b.N)
+			used, min, max := 0, b.N, 0
+			for _, c := range counts {
+				if c > 0 {
+					used++
+				}
+				if c < min {
+					min = c
+				}
+				if c > max {
+					max = c
+				}
+			}
+			b.Logf("N=%d : %d of %d workers used , requests per worker min %d max %d", b.N, used, len(counts), min, max)
+		})
+	}
+}
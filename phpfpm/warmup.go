@@ -0,0 +1,88 @@
+package phpfpm
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"wphpfpm/conf"
+)
+
+// defaultWarmupTimeout Warmup 沒有設定 Timeout 時的預設值
+const defaultWarmupTimeout = 10 * time.Second
+
+// unhealthyRestartDelay warmup 失敗的 php-cgi 被終止後 , 等待多久才重新啟動
+var unhealthyRestartDelay = 5 * time.Second
+
+// warmup 依序送出 Instance 的 Warmup 要求 , 全部成功才能放進 idleProcesses
+func (p *Process) warmup() error {
+	for _, w := range p.m.instance.Warmup {
+		if err := p.warmupRequest(w); err != nil {
+			return fmt.Errorf("%s : %s", w.Script, err.Error())
+		}
+	}
+	return nil
+}
+
+// warmupRequest 送出一個 GET 要求並等待 php-cgi 處理完畢 , 回應內容會被丟棄
+func (p *Process) warmupRequest(w conf.Warmup) error {
+	timeout := defaultWarmupTimeout
+	if w.Timeout > 0 {
+		timeout = time.Duration(w.Timeout) * time.Second
+	}
+	deadline := time.Now().Add(timeout)
+
+	// TryStart 已經確認 php-cgi 可以連線
+	conn, err := dialPipe(p.pippedName)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+	// php-cgi 的 PHP_FCGI_MAX_REQUESTS 也會計算 warmup
+	p.requestCount++
+
+	params := map[string]string{
+		"GATEWAY_INTERFACE": "CGI/1.1",
+		"SERVER_SOFTWARE":   "wphpfpm",
+		"SERVER_PROTOCOL":   "HTTP/1.1",
+		"REQUEST_METHOD":    "GET",
+		"SCRIPT_FILENAME":   w.Script,
+	}
+	for k, v := range w.Params {
+		params[k] = v
+	}
+
+	// 只需要 header 判斷 Status
+	stdout, _, appStatus, err := roundTrip(conn, params, nil, 8192)
+	if err != nil {
+		return err
+	}
+	if appStatus != 0 {
+		return fmt.Errorf("app status %d", appStatus)
+	}
+	return checkStatus(stdout)
+}
+
+// checkStatus 檢查 php-cgi 回應的 Status header , 沒有 Status 代表 200
+func checkStatus(stdout []byte) error {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(stdout))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return nil
+	}
+	status := header.Get("Status")
+	if status == "" {
+		return nil
+	}
+	code, err := strconv.Atoi(strings.Fields(status)[0])
+	if err != nil {
+		return fmt.Errorf("invalid Status %s", status)
+	}
+	if code >= 500 {
+		return fmt.Errorf("Status %s", status)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+//go:build !windows
+// +build !windows
+
+package phpfpm
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"wphpfpm/conf"
+	"wphpfpm/hook"
+)
+
+func TestWarmup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	requests := filepath.Join(dir, "requests")
+
+	m := newTestManager(t, conf.Instance{
+		MaxProcesses: 2,
+		Env:          []string{"WPHPFPM_FAKE_LOG=" + requests},
+		Warmup:       []conf.Warmup{{Script: "/srv/warm.php", Params: map[string]string{"SERVER_NAME": "example.com"}}},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	// 每個 php-cgi 放進 idle 之前都已經執行過 warmup
+	b, err := ioutil.ReadFile(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != strings.Repeat("/srv/warm.php example.com\n", 2) {
+		t.Errorf("unexpected warmup requests %q", s)
+	}
+	if stats := m.Stats(); stats.Idle != 2 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	p := m.Acquire()
+	if p.requestCount != 1 {
+		t.Errorf("warmup should be counted as a request , got %d", p.requestCount)
+	}
+	m.Release(p)
+}
+
+func TestWarmupFailed(t *testing.T) {
+	defer func(d time.Duration) { unhealthyRestartDelay = d }(unhealthyRestartDelay)
+	unhealthyRestartDelay = 300 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "wphpfpm-warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fail := filepath.Join(dir, "fail")
+	ioutil.WriteFile(fail, nil, 0644)
+
+	m := newTestManager(t, conf.Instance{
+		MaxProcesses: 1,
+		Env:          []string{"WPHPFPM_FAKE_FAIL=" + fail},
+		Warmup:       []conf.Warmup{{Script: "/srv/fail.php"}},
+	})
+	events := make(chan hook.Event, 8)
+	bus := hook.NewBus()
+	bus.Add("test", chanSink(events), hook.Options{})
+	defer bus.Close(context.Background())
+	m.SetEvents(bus)
+
+	// warmup 失敗的 php-cgi 被終止 , 不會放進 idle
+	start := time.Now()
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if stats := m.Stats(); stats.Idle != 0 {
+		t.Errorf("unhealthy php-cgi should not be idle %+v", stats)
+	}
+	if m.Acquire() != nil {
+		t.Error("unhealthy php-cgi should not be acquired")
+	}
+	select {
+	case e := <-events:
+		if e.Type != hook.ProcessUnhealthy || !strings.Contains(e.Message, "/srv/fail.php") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process.unhealthy event is not sent")
+	}
+
+	// 延遲後重新啟動 , warmup 成功才放進 idle
+	os.Remove(fail)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Stats().Idle != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("php-cgi is not restarted after warmup failed %+v", m.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if elapsed := time.Since(start); elapsed < unhealthyRestartDelay {
+		t.Errorf("php-cgi is restarted after %s , before unhealthyRestartDelay", elapsed)
+	}
+	p := m.Acquire()
+	if p == nil || p.unhealthy {
+		t.Fatal("expected a healthy php-cgi")
+	}
+	m.Release(p)
+}
+
+func TestWarmupFailedOnRecycle(t *testing.T) {
+	defer func(d time.Duration) { unhealthyRestartDelay = d }(unhealthyRestartDelay)
+	unhealthyRestartDelay = 300 * time.Millisecond
+
+	dir, err := ioutil.TempDir("", "wphpfpm-warmup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fail := filepath.Join(dir, "fail")
+
+	// warmup 也算一次要求 , 之後的第一個要求結束時就會重新啟動
+	m := newTestManager(t, conf.Instance{
+		MaxProcesses:          1,
+		MaxRequestsPerProcess: 2,
+		Env:                   []string{"WPHPFPM_FAKE_FAIL=" + fail},
+		Warmup:                []conf.Warmup{{Script: "/srv/fail.php"}},
+	})
+	events := make(chan hook.Event, 8)
+	bus := hook.NewBus()
+	bus.Add("test", chanSink(events), hook.Options{})
+	defer bus.Close(context.Background())
+	m.SetEvents(bus)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	ioutil.WriteFile(fail, nil, 0644)
+	params := map[string]string{"REQUEST_METHOD": "GET", "SCRIPT_FILENAME": "/index.php"}
+	if _, err := m.Do(context.Background(), params, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 重新啟動時 warmup 失敗 , 只送出 process.unhealthy , monProcess 會再重試 , 不是 restart.failed
+	select {
+	case e := <-events:
+		if e.Type != hook.ProcessUnhealthy {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("process.unhealthy event is not sent")
+	}
+	os.Remove(fail)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.Stats().Idle != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("php-cgi is not restarted after warmup failed %+v", m.Stats())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	default:
+	}
+}
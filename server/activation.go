@@ -0,0 +1,62 @@
+package server
+
+import (
+	"net"
+)
+
+// InheritedListener 是由外部 (如 systemd socket activation) 傳進來 , 已經在 listen 的 listener
+type InheritedListener struct {
+	// Name 來自 LISTEN_FDNAMES , 沒有指定時為空字串
+	Name     string
+	Listener net.Listener
+}
+
+// MatchListener 從 listeners 中找出符合 name 或 bind 的 listener , 找到後會從 listeners 移除
+// name 優先比對 , 其次比對位址 , 都找不到返回 nil
+func MatchListener(listeners *[]InheritedListener, name string, bind string) net.Listener {
+	index := -1
+	for i, l := range *listeners {
+		if name != "" && l.Name == name {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		for i, l := range *listeners {
+			if addrMatches(l.Listener.Addr(), bind) {
+				index = i
+				break
+			}
+		}
+	}
+	if index < 0 {
+		return nil
+	}
+	l := (*listeners)[index].Listener
+	*listeners = append((*listeners)[:index], (*listeners)[index+1:]...)
+	return l
+}
+
+// addrMatches 比對 listener 的位址與 Bind 是否相同
+// Bind 的 IP 未指定 (如 :8000 或 0.0.0.0:8000) 時只比對 Port
+func addrMatches(addr net.Addr, bind string) bool {
+	network, address := ParseBindAddress(bind)
+	switch a := addr.(type) {
+	case *net.UnixAddr:
+		return network == "unix" && a.Name == address
+	case *net.TCPAddr:
+		if network != "tcp" {
+			return false
+		}
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return false
+		}
+		bindAddr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(host, port))
+		if err != nil || bindAddr.Port != a.Port {
+			return false
+		}
+		return bindAddr.IP == nil || bindAddr.IP.IsUnspecified() || bindAddr.IP.Equal(a.IP)
+	}
+	return false
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMatchListener(t *testing.T) {
+	var listeners []InheritedListener
+	for _, name := range []string{"php7", ""} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners = append(listeners, InheritedListener{Name: name, Listener: l})
+	}
+	first := listeners[0].Listener
+	second := listeners[1].Listener
+	_, port, _ := net.SplitHostPort(second.Addr().String())
+
+	if l := MatchListener(&listeners, "php8", "127.0.0.1:1"); l != nil {
+		t.Errorf("unexpected match %s", l.Addr().String())
+	}
+	if l := MatchListener(&listeners, "php7", "127.0.0.1:1"); l != first {
+		t.Error("should match by name")
+	}
+	if l := MatchListener(&listeners, "", "0.0.0.0:"+port); l != second {
+		t.Error("should match unspecified IP by port")
+	}
+	if len(listeners) != 0 {
+		t.Errorf("matched listeners should be removed , %d left", len(listeners))
+	}
+}
@@ -0,0 +1,59 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart systemd 傳入的第一個 fd
+const listenFdsStart = 3
+
+// InheritedListeners 取得 systemd socket activation (LISTEN_FDS / LISTEN_FDNAMES) 傳入的 listener
+// 讀取後會清除這些環境變數 , 避免 php-cgi 等子行程誤用 , 所以只有第一次呼叫有效
+func InheritedListeners() ([]InheritedListener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// 不是傳給這個行程的
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	var names []string
+	if s := os.Getenv("LISTEN_FDNAMES"); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	listeners := make([]InheritedListener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+		name := ""
+		if i := fd - listenFdsStart; i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener 會複製 fd , 原本的可以關閉
+		if err != nil {
+			for _, inherited := range listeners {
+				inherited.Listener.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, InheritedListener{Name: name, Listener: renamedListener(l)})
+	}
+	return listeners, nil
+}
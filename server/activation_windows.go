@@ -0,0 +1,6 @@
+package server
+
+// InheritedListeners windows 沒有 socket activation , 一律返回 nil
+func InheritedListeners() ([]InheritedListener, error) {
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"wphpfpm/hook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// parseAllowedClients 將 IP 或 CIDR 字串轉為 *net.IPNet , 單一 IP 視為 /32 或 /128
+func parseAllowedClients(clients []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(clients))
+	for _, client := range clients {
+		client = strings.TrimSpace(client)
+		if strings.Contains(client, "/") {
+			_, ipnet, err := net.ParseCIDR(client)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+			continue
+		}
+		ip := net.ParseIP(client)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid allowed client %s", client)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// isAllowed 檢查連線來源是否在 AllowedClients 中
+// 沒有設定 AllowedClients , 或是 unix socket / named pipe 等非 IP 的連線一律允許
+func (s *Server) isAllowed(conn net.Conn) bool {
+	if len(s.allowedNets) == 0 {
+		return true
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, ipnet := range s.allowedNets {
+		if ipnet.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// reject 關閉不被允許的連線並計數
+func (s *Server) reject(conn net.Conn) {
+	atomic.AddUint64(&s.rejected, 1)
+	if log.IsLevelEnabled(log.WarnLevel) {
+		s.logger().WithField("remote_addr", conn.RemoteAddr().String()).Warn("Client rejected , not in AllowedClients")
+	}
+	if s.Events != nil {
+		s.Events.Publish(hook.Event{Type: hook.ClientRejected, Source: s.source(), Client: clientIP(conn), Message: "client is not in AllowedClients"})
+	}
+	conn.Close()
+}
+
+// RejectedCount 返回因為 AllowedClients 而被拒絕的連線數量
+func (s *Server) RejectedCount() uint64 {
+	return atomic.LoadUint64(&s.rejected)
+}
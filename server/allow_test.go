@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"wphpfpm/hook"
+)
+
+// startTestServer 啟動一個回應 "ok" 的 Server , 等待 listen 完成後返回
+func startTestServer(t *testing.T, s *Server) {
+	ready := make(chan struct{})
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			c.Write([]byte("ok"))
+			return Close
+		},
+	}
+	go s.Serve(context.Background(), events)
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server does not start")
+	}
+}
+
+func readReply(t *testing.T, addr string) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2)
+	n, _ := conn.Read(b)
+	return string(b[:n])
+}
+
+func TestAllowedClients(t *testing.T) {
+	denied := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, AllowedClients: []string{"10.0.0.0/8", "::1"}}
+	startTestServer(t, denied)
+	defer denied.Shutdown(context.Background())
+
+	if reply := readReply(t, denied.Addr().String()); reply != "" {
+		t.Errorf("client should be rejected , got %q", reply)
+	}
+	if denied.RejectedCount() != 1 {
+		t.Errorf("expected 1 rejected , got %d", denied.RejectedCount())
+	}
+
+	allowed := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, AllowedClients: []string{"127.0.0.1"}}
+	startTestServer(t, allowed)
+	defer allowed.Shutdown(context.Background())
+
+	if reply := readReply(t, allowed.Addr().String()); reply != "ok" {
+		t.Errorf("client should be allowed , got %q", reply)
+	}
+	if allowed.RejectedCount() != 0 {
+		t.Errorf("expected 0 rejected , got %d", allowed.RejectedCount())
+	}
+}
+
+func TestAllowedClientsInvalid(t *testing.T) {
+	s := &Server{BindAddress: "127.0.0.1:0", AllowedClients: []string{"localhost"}}
+	if err := s.Serve(context.Background(), Event{}); err == nil {
+		t.Error("expected invalid AllowedClients error")
+	}
+}
+
+// chanSink 將收到的事件送進 channel
+type chanSink chan hook.Event
+
+func (s chanSink) Send(ctx context.Context, e hook.Event) error {
+	s <- e
+	return nil
+}
+
+func TestRejectEvents(t *testing.T) {
+	// 沒有設定 Events 時不通知
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, AllowedClients: []string{"10.0.0.0/8"}}
+	startTestServer(t, s)
+	defer s.Shutdown(context.Background())
+	readReply(t, s.Addr().String())
+	if s.RejectedCount() != 1 {
+		t.Errorf("expected 1 rejected , got %d", s.RejectedCount())
+	}
+
+	sink := make(chanSink, 10)
+	bus := hook.NewBus()
+	bus.Add("test", sink, hook.Options{})
+	defer bus.Close(context.Background())
+
+	// reject 及 throttle 的 Source 都與 log 的 instance 欄位相同
+	rejecting := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, Name: "web", Events: bus, AllowedClients: []string{"10.0.0.0/8"}}
+	startTestServer(t, rejecting)
+	defer rejecting.Shutdown(context.Background())
+	readReply(t, rejecting.Addr().String())
+
+	throttling := &Server{BindAddress: "127.0.0.1:0", Name: "web", Events: bus}
+	client, conn := net.Pipe()
+	defer client.Close()
+	throttling.throttle(conn)
+
+	for _, expected := range []hook.Type{hook.ClientRejected, hook.ClientThrottled} {
+		select {
+		case e := <-sink:
+			if e.Type != expected || e.Source != "web" {
+				t.Errorf("expected %s from web , got %s from %s", expected, e.Type, e.Source)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s event", expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/net/netutil"
+)
+
+// GuardListener 返回套用 AllowedClients , MaxConnectionsPerClient 及 MaxConnections 的 listener
+// 給 HTTPListen 的 http.Server 使用 , 與 Serve 相同 , 被拒絕的連線會記錄 log , 送出事件並計數
+// 只使用 s 的設定 , 不需要呼叫 Serve
+func (s *Server) GuardListener(l net.Listener) (net.Listener, error) {
+	var err error
+	if s.allowedNets, err = parseAllowedClients(s.AllowedClients); err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	s.clients = make(map[string]int)
+	s.mutex.Unlock()
+	if s.MaxConnections > 0 {
+		l = netutil.LimitListener(l, s.MaxConnections)
+	}
+	return &guardListener{Listener: l, server: s}, nil
+}
+
+type guardListener struct {
+	net.Listener
+	server *Server
+}
+
+// Accept 同 net.Listener.Accept , 不被允許的連線直接關閉 , 繼續等待下一個連線
+func (l *guardListener) Accept() (net.Conn, error) {
+	s := l.server
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if !s.isAllowed(conn) {
+			s.reject(conn)
+			continue
+		}
+		client := clientIP(conn)
+		s.mutex.Lock()
+		ok := s.addClient(client)
+		s.mutex.Unlock()
+		if !ok {
+			s.throttle(conn)
+			continue
+		}
+		return &guardConn{Conn: conn, server: s, client: client}, nil
+	}
+}
+
+// guardConn Close 時減少來源 IP 的連線數量
+type guardConn struct {
+	net.Conn
+	server *Server
+	client string
+	once   sync.Once
+}
+
+// Close 同 net.Conn.Close
+func (c *guardConn) Close() error {
+	c.once.Do(func() {
+		c.server.mutex.Lock()
+		c.server.removeClient(c.client)
+		c.server.mutex.Unlock()
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptAll 接受 l 的連線 , 送出 "ok" 後交給 accepted , 直到 l 關閉
+func acceptAll(l net.Listener, accepted chan<- net.Conn) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		conn.Write([]byte("ok"))
+		accepted <- conn
+	}
+}
+
+func TestGuardListener(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	s := &Server{BindAddress: raw.Addr().String(), AllowedClients: []string{"10.0.0.0/8"}}
+	l, err := s.GuardListener(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 4)
+	go acceptAll(l, accepted)
+
+	if reply := readReply(t, raw.Addr().String()); reply != "" {
+		t.Errorf("client should be rejected , got %q", reply)
+	}
+	if s.RejectedCount() != 1 {
+		t.Errorf("expected 1 rejected , got %d", s.RejectedCount())
+	}
+
+	if _, err := (&Server{AllowedClients: []string{"localhost"}}).GuardListener(raw); err == nil {
+		t.Error("expected invalid AllowedClients error")
+	}
+}
+
+func TestGuardListenerPerClient(t *testing.T) {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	s := &Server{BindAddress: raw.Addr().String(), MaxConnectionsPerClient: 1}
+	l, err := s.GuardListener(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan net.Conn, 4)
+	go acceptAll(l, accepted)
+
+	first, err := net.Dial("tcp", raw.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not accepted")
+	}
+
+	// 同一個 IP 的第二個連線超過上限 , 直接被關閉
+	if reply := readReply(t, raw.Addr().String()); reply != "" {
+		t.Errorf("client should be throttled , got %q", reply)
+	}
+	if s.ThrottledCount() != 1 {
+		t.Errorf("expected 1 throttled , got %d", s.ThrottledCount())
+	}
+
+	// 關閉後釋放名額
+	conn.Close()
+	if reply := readReply(t, raw.Addr().String()); reply != "ok" {
+		t.Errorf("client should be allowed after the connection is closed , got %q", reply)
+	}
+}
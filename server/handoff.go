@@ -0,0 +1,25 @@
+package server
+
+import (
+	"fmt"
+	"os"
+)
+
+// ListenerFile 返回 listener 的 *os.File (複製過的 fd) , 升級時傳給新的行程使用
+func (s *Server) ListenerFile() (*os.File, error) {
+	l, ok := s.rawListener.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("listener %s can not be handed off", s.BindAddress)
+	}
+	return l.File()
+}
+
+// HandOff 標記 listener 已經交給新的行程 , 之後 Shutdown 不會移除 unix socket 檔案
+func (s *Server) HandOff() {
+	s.ownSocket = false
+	if l, ok := s.rawListener.(interface{ SetUnlinkOnClose(bool) }); ok {
+		l.SetUnlinkOnClose(false)
+	}
+}
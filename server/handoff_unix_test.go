@@ -0,0 +1,80 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHandOff(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-handoff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fcgi.sock")
+
+	ready := make(chan struct{})
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			c.Write([]byte("old"))
+			return Close
+		},
+	}
+	s := &Server{BindAddress: "unix:" + path, MaxConnections: 4}
+	go s.Serve(context.Background(), events)
+	<-ready
+
+	f, err := s.ListenerFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 交出 listener 後 , Shutdown 不能移除 socket 檔案
+	s.HandOff()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("socket is removed after HandOff : %v", err)
+	}
+
+	// 新的行程以傳入的 listener 繼續服務 , OwnListener 時 Shutdown 移除 socket 檔案
+	ready = make(chan struct{})
+	events.OnConnect = func(c *Conn) Action {
+		c.Write([]byte("new"))
+		return Close
+	}
+	s2 := &Server{BindAddress: "unix:" + path, MaxConnections: 4, Listener: l, OwnListener: true}
+	go s2.Serve(context.Background(), events)
+	<-ready
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	if string(b) != "new" {
+		t.Errorf("response = %q , want new", b)
+	}
+	if err := s2.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket is not removed by the owner : %v", err)
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"wphpfpm/hook"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// throttleLogInterval 同一個 Server 記錄 throttle 訊息的最短間隔
+const throttleLogInterval = time.Second
+
+// clientIP 返回連線的來源 IP , unix socket 及 named pipe 等非 IP 的連線返回空字串
+func clientIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// throttle 關閉超過 MaxConnectionsPerClient 的連線並計數 , 每 throttleLogInterval 最多記錄一次
+func (s *Server) throttle(conn net.Conn) {
+	count := atomic.AddUint64(&s.throttled, 1)
+	if log.IsLevelEnabled(log.WarnLevel) {
+		now := time.Now().UnixNano()
+		last := atomic.LoadInt64(&s.throttleLogged)
+		if now-last >= int64(throttleLogInterval) && atomic.CompareAndSwapInt64(&s.throttleLogged, last, now) {
+			s.logger().WithFields(log.Fields{"remote_addr": conn.RemoteAddr().String(), "throttled": count}).Warnf("Client throttled , more than %d connections", s.MaxConnectionsPerClient)
+		}
+	}
+	if s.Events != nil {
+		s.Events.Publish(hook.Event{Type: hook.ClientThrottled, Source: s.source(), Client: clientIP(conn), Message: fmt.Sprintf("client has more than %d connections", s.MaxConnectionsPerClient)})
+	}
+	conn.Close()
+}
+
+// ThrottledCount 返回因為 MaxConnectionsPerClient 而被關閉的連線數量
+func (s *Server) ThrottledCount() uint64 {
+	return atomic.LoadUint64(&s.throttled)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMaxConnectionsPerClient(t *testing.T) {
+	ready := make(chan struct{})
+	release := make(chan struct{})
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			<-release
+			c.Write([]byte("ok"))
+			return Close
+		},
+	}
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 8, MaxConnectionsPerClient: 2}
+	go s.Serve(context.Background(), events)
+	<-ready
+	defer s.Shutdown(context.Background())
+
+	conns := make([]net.Conn, 0, 2)
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+	waitActive(t, s, 2)
+
+	// 第三個連線超過上限 , 直接被關閉
+	if reply := readReply(t, s.Addr().String()); reply != "" {
+		t.Errorf("client should be throttled , got %q", reply)
+	}
+	if s.ThrottledCount() != 1 {
+		t.Errorf("expected 1 throttled , got %d", s.ThrottledCount())
+	}
+
+	close(release)
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b := make([]byte, 2)
+		if n, _ := conn.Read(b); string(b[:n]) != "ok" {
+			t.Errorf("expected ok , got %q", b[:n])
+		}
+	}
+	waitActive(t, s, 0)
+
+	// 連線結束後釋放名額
+	if reply := readReply(t, s.Addr().String()); reply != "ok" {
+		t.Errorf("client should be allowed after connections closed , got %q", reply)
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ParseBindAddress 解析 BindAddress , 返回 network 及 address
+//
+//	unix:/run/wphpfpm/site.sock  => unix , /run/wphpfpm/site.sock
+//	pipe:site1                   => pipe , \\.\pipe\site1
+//	\\.\pipe\site1               => pipe , \\.\pipe\site1
+//	127.0.0.1:8000               => tcp , 127.0.0.1:8000
+func ParseBindAddress(bind string) (network string, address string) {
+	switch {
+	case strings.HasPrefix(bind, "unix:"):
+		return "unix", bind[len("unix:"):]
+	case strings.HasPrefix(bind, "pipe:"):
+		return "pipe", `\\.\pipe\` + bind[len("pipe:"):]
+	case strings.HasPrefix(bind, `\\.\pipe\`):
+		return "pipe", bind
+	}
+	return "tcp", bind
+}
+
+// WriteTimeoutListener 返回的 listener 接受的連線 , 每次 Write 的期限為 timeout , 同 Server 的 WriteTimeout
+// 給 http.Server 使用 , 它的 WriteTimeout 限制的是整個回應 , 會中斷執行較久的 script
+func WriteTimeoutListener(l net.Listener, timeout time.Duration) net.Listener {
+	if timeout <= 0 {
+		return l
+	}
+	return &writeTimeoutListener{Listener: l, timeout: timeout}
+}
+
+type writeTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+// Accept 同 net.Listener.Accept
+func (l *writeTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeTimeoutConn{Conn: conn, timeout: l.timeout}, nil
+}
+
+type writeTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// Write 同 net.Conn.Write , 每次寫入前設定期限
+func (c *writeTimeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// listen 依照 BindAddress 建立 listener
+func (s *Server) listen() (net.Listener, error) {
+	network, address := ParseBindAddress(s.BindAddress)
+	switch network {
+	case "unix":
+		return s.listenUnix(address)
+	case "pipe":
+		return listenPipe(address)
+	}
+	return net.Listen(network, address)
+}
+
+// socketTmpDir 建立 unix socket 時 , 先在 path 加上此字尾的私有目錄 (0700) 中 listen ,
+// 設定好 ListenOwner , ListenGroup 及 ListenMode 後才 rename 到 path , 避免 socket 短暫以 umask 的權限對外開放
+const socketTmpDir = ".tmp"
+
+// socketTmpName 私有目錄中 socket 的檔名 , 盡量短 , unix socket 的路徑長度有限制
+const socketTmpName = "s"
+
+// listenUnix 建立 unix socket , 並設定 ListenOwner , ListenGroup 及 ListenMode
+func (s *Server) listenUnix(path string) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	dir := path + socketTmpDir
+	tmp := filepath.Join(dir, socketTmpName)
+	// 上次沒有正常結束所留下的 , 目錄不是空的時 Remove 會失敗 , 由 Mkdir 返回錯誤
+	os.Remove(tmp)
+	os.Remove(dir)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return nil, err
+	}
+	defer os.Remove(dir)
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	// socket 檔案會被 rename , 由 Shutdown 時的 removeSocket 移除
+	ul.SetUnlinkOnClose(false)
+	if err = s.setSocketOwner(tmp); err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		l.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+	return &unixListener{UnixListener: ul, addr: &net.UnixAddr{Name: path, Net: "unix"}}, nil
+}
+
+// setSocketOwner 設定 socket 檔案的 ListenMode , ListenOwner 及 ListenGroup
+func (s *Server) setSocketOwner(path string) error {
+	if s.ListenMode != 0 {
+		if err := os.Chmod(path, s.ListenMode); err != nil {
+			return err
+		}
+	}
+	if s.ListenOwner != "" || s.ListenGroup != "" {
+		return chownSocket(path, s.ListenOwner, s.ListenGroup)
+	}
+	return nil
+}
+
+// unixListener listen 之後才 rename 的 unix socket , Addr 返回 rename 後的路徑
+type unixListener struct {
+	*net.UnixListener
+	addr net.Addr
+}
+
+// Addr 返回 rename 後的路徑
+func (l *unixListener) Addr() net.Addr {
+	return l.addr
+}
+
+// renamedListener 升級時傳入的 unix socket 仍然以私有目錄中的路徑回報位址 , 換回 rename 後的路徑
+func renamedListener(l net.Listener) net.Listener {
+	ul, ok := l.(*net.UnixListener)
+	if !ok {
+		return l
+	}
+	dir, name := filepath.Split(ul.Addr().String())
+	dir = filepath.Clean(dir)
+	if name != socketTmpName || !strings.HasSuffix(dir, socketTmpDir) {
+		return l
+	}
+	return &unixListener{UnixListener: ul, addr: &net.UnixAddr{Name: strings.TrimSuffix(dir, socketTmpDir), Net: "unix"}}
+}
+
+// removeStaleSocket 移除上次沒有正常結束所留下的 socket 檔案
+// 如果還有其他程式在 listen , 則返回錯誤
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	return os.Remove(path)
+}
+
+// removeSocket 在 Shutdown 時移除 unix socket 檔案
+func (s *Server) removeSocket() {
+	network, address := ParseBindAddress(s.BindAddress)
+	if network != "unix" || !s.ownSocket {
+		return
+	}
+	if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+		s.logger().WithError(err).Warn("Server remove socket error")
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// listenPipe named pipe 只有 windows 支援
+func listenPipe(address string) (net.Listener, error) {
+	return nil, errors.New("named pipe is not supported on this platform")
+}
+
+// chownSocket 設定 socket 檔案的擁有者及群組 , 可以是名稱或數字
+func chownSocket(path string, owner string, group string) error {
+	uid, gid := -1, -1
+	if owner != "" {
+		u, err := user.Lookup(owner)
+		if err != nil {
+			if u, err = user.LookupId(owner); err != nil {
+				return err
+			}
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return err
+		}
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return err
+			}
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return err
+		}
+	}
+	return os.Chown(path, uid, gid)
+}
@@ -0,0 +1,149 @@
+//go:build !windows
+// +build !windows
+
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fcgi.sock")
+
+	// 上次異常結束留下的 socket 檔案
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ready := make(chan struct{})
+	s := &Server{
+		BindAddress: "unix:" + path,
+		ListenOwner: strconv.Itoa(os.Getuid()),
+		ListenGroup: strconv.Itoa(os.Getgid()),
+		ListenMode:  0660,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(context.Background(), Event{OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		}})
+	}()
+	select {
+	case <-ready:
+	case err := <-served:
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0660 || int(st.Uid) != os.Getuid() || int(st.Gid) != os.Getgid() {
+		t.Errorf("socket mode %s , owner %d:%d", fi.Mode(), st.Uid, st.Gid)
+	}
+	if _, err := os.Stat(path + socketTmpDir); !os.IsNotExist(err) {
+		t.Errorf("private directory is not removed : %v", err)
+	}
+	if s.Addr().String() != path {
+		t.Errorf("Addr = %s , want %s", s.Addr(), path)
+	}
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// 已經有其他程式在 listen
+	if _, err := (&Server{BindAddress: "unix:" + path}).listen(); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("expected already in use error , got %v", err)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve : %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket is not removed on Shutdown : %v", err)
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fcgi.sock")
+	if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&Server{BindAddress: "unix:" + path}).listen(); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("expected not a socket error , got %v", err)
+	}
+	// 無法設定擁有者時不留下 socket 檔案
+	os.Remove(path)
+	if _, err := (&Server{BindAddress: "unix:" + path, ListenOwner: "wphpfpm-no-such-user"}).listen(); err == nil {
+		t.Error("expected unknown user error")
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket is left after error : %v", err)
+	}
+	if _, err := os.Lstat(path + socketTmpDir); !os.IsNotExist(err) {
+		t.Errorf("private directory is left after error : %v", err)
+	}
+}
+
+func TestRenamedListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-listen")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "fcgi.sock")
+	l, err := (&Server{BindAddress: "unix:" + path}).listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// 升級時新的行程取得的 listener 回報的是私有目錄中的路徑
+	f, err := l.(*unixListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inherited, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+	if got := inherited.Addr().String(); got != filepath.Join(path+socketTmpDir, socketTmpName) {
+		t.Fatalf("inherited Addr = %s", got)
+	}
+	if got := renamedListener(inherited).Addr().String(); got != path {
+		t.Errorf("renamed Addr = %s , want %s", got, path)
+	}
+	if !addrMatches(renamedListener(inherited).Addr(), "unix:"+path) {
+		t.Error("renamed listener does not match Bind")
+	}
+}
@@ -0,0 +1,18 @@
+package server
+
+import (
+	"errors"
+	"net"
+
+	"gopkg.in/natefinch/npipe.v2"
+)
+
+// listenPipe 建立 windows named pipe listener
+func listenPipe(address string) (net.Listener, error) {
+	return npipe.Listen(address)
+}
+
+// chownSocket windows 不支援設定 socket 的擁有者
+func chownSocket(path string, owner string, group string) error {
+	return errors.New("ListenOwner and ListenGroup are not supported on windows")
+}
@@ -1,7 +1,14 @@
 package server
 
 import (
+	"context"
+	"crypto/tls"
 	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"wphpfpm/hook"
 
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/net/netutil"
@@ -9,50 +16,219 @@ import (
 
 // Server 定義 Server 的一些參數
 type Server struct {
+	// rejected 被 AllowedClients 拒絕的連線數量 , 放在第一個欄位確保 atomic 操作時 64 位元對齊
+	rejected uint64
+	// throttled 超過 MaxConnectionsPerClient 而被關閉的連線數量
+	throttled uint64
+	// throttleLogged 最後一次記錄 throttle 訊息的時間 (UnixNano) , 避免大量連線時洗版
+	throttleLogged int64
 	// 自定義 Tag
 	Tag interface{}
+	// Name 記錄 log 時的 instance 欄位 , 空的代表不記錄
+	Name string
 	// MaxConnections 定義最大連接數量，必須大於 0 , 否則無上限
 	MaxConnections int
+	// MaxConnectionsPerClient 每個來源 IP 同時處理中的連線上限 , 超過時直接關閉 , 0 代表不限制 , 對 unix socket 及 named pipe 無效
+	MaxConnectionsPerClient int
 	// BindAddress 定義要 listen 的 Address 及 Port , 如 127.0.0.1:8000
+	// 也可以是 unix:/path/to.sock 或 windows named pipe (pipe:name 或 \\.\pipe\name)
 	BindAddress string
+	// ListenOwner , ListenGroup 及 ListenMode 只對 unix socket 有效 , 同 php-fpm 的 listen.owner , listen.group 及 listen.mode
+	ListenOwner string
+	ListenGroup string
+	ListenMode  os.FileMode
+	// AllowedClients 允許連線的 IP 或 CIDR , 同 php-fpm 的 listen.allowed_clients , 空的代表不限制
+	AllowedClients []string
+	allowedNets    []*net.IPNet
+	// Events 連線被 AllowedClients 拒絕或超過 MaxConnectionsPerClient 時通知的 Bus , nil 代表不通知
+	Events *hook.Bus
+	// TLS 設定後 listener 會以 TLS 加密 , nil 代表不使用
+	TLS *TLSOptions
+	// Listener 設定後 Serve 會直接使用 , 不會自己 listen , 如 systemd socket activation 傳入的 listener
+	Listener net.Listener
+	// ReadHeaderTimeout 連線後必須在此時間內讀完第一個要求的 head , 讀完後由 OnConnect 呼叫 Conn.HeaderRead , 0 代表不限制
+	ReadHeaderTimeout time.Duration
+	// IdleTimeout 連線上雙向都沒有資料超過此時間時 , Read 返回 timeout 錯誤 , 0 代表不限制
+	IdleTimeout time.Duration
+	// WriteTimeout 每次 Write 的期限 , 0 代表不限制
+	WriteTimeout time.Duration
+	// OwnListener 為 true 時 , Listener 的 unix socket 檔案視同自己建立 , Shutdown 時會移除 (如升級時由舊的行程傳入)
+	OwnListener bool
 	listener    net.Listener
-
-	shutdownChan chan bool // 此值如果為 true , 代表 Server 必須停止，所有工作都需要關閉
-	shutdown     bool
+	rawListener net.Listener   // 尚未被 LimitListener 及 TLS 包裝的 listener
+	ownSocket   bool           // unix socket 檔案是否由 Server 自己建立 , Shutdown 時只移除自己建立的
+	conns       sync.WaitGroup // 處理中的連線 , 可藉由 Wait() 等待全部結束
+
+	mutex    sync.Mutex
+	active   map[*Conn]struct{} // 處理中的連線 , Shutdown 逾時時強制關閉
+	clients  map[string]int     // 每個來源 IP 處理中的連線數量
+	shutdown bool               // 已經呼叫 Shutdown 或 Serve 的 ctx 已經結束
+	cancel   context.CancelFunc // 取消所有連線的 context
 }
 
 // Conn 是當 Accept 後產生的連線物件
 type Conn struct {
-	net.Conn // 繼承原本的 net.Conn
-	ctx      interface{}
-	server   *Server // Server
+	// lastActivity 最後一次讀寫的時間 (UnixNano) , 放在第一個欄位確保 atomic 操作時 64 位元對齊
+	lastActivity int64
+	net.Conn     // 繼承原本的 net.Conn
+	ctx          context.Context
+	cancel       context.CancelFunc
+	userData     interface{}
+	server       *Server // Server
+	client       string  // 來源 IP , 非 IP 的連線為空字串
+	// headerDeadline 非零時代表還沒讀完第一個要求的 head
+	headerDeadline time.Time
+}
+
+// Read 同 net.Conn.Read , 套用 Server 的 ReadHeaderTimeout 及 IdleTimeout
+func (c *Conn) Read(b []byte) (int, error) {
+	idle := c.server.IdleTimeout
+	if idle <= 0 && c.headerDeadline.IsZero() {
+		return c.Conn.Read(b)
+	}
+	for {
+		deadline := c.headerDeadline
+		if idle > 0 {
+			if d := time.Unix(0, atomic.LoadInt64(&c.lastActivity)).Add(idle); deadline.IsZero() || d.Before(deadline) {
+				deadline = d
+			}
+		}
+		c.Conn.SetReadDeadline(deadline)
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.touch()
+		}
+		if err != nil && idle > 0 && c.headerDeadline.IsZero() && isTimeout(err) {
+			// 等待期間有寫出資料 (如 php-cgi 正在輸出) , 還不算閒置
+			if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastActivity))) < idle {
+				continue
+			}
+		}
+		return n, err
+	}
+}
+
+// Write 同 net.Conn.Write , 套用 Server 的 WriteTimeout
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.server.WriteTimeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
+	}
+	n, err := c.Conn.Write(b)
+	if n > 0 && c.server.IdleTimeout > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// HeaderRead 通知第一個要求的 head 已經讀完 , 之後不再套用 ReadHeaderTimeout
+// 必須在同一個 goroutine 中 , 在之後的 Read 之前呼叫
+func (c *Conn) HeaderRead() {
+	if !c.headerDeadline.IsZero() {
+		c.headerDeadline = time.Time{}
+		c.Conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// touch 記錄最後一次讀寫的時間
+func (c *Conn) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+// isTimeout err 是否為逾時錯誤
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// SetUserData 設定任意型態的關聯資源 , 可藉由 UserData() 取得
+func (c *Conn) SetUserData(data interface{}) {
+	c.userData = data
 }
 
-// SetContext 設定任意型態的關聯資源 , 可藉由 Context() 取得
-func (c *Conn) SetContext(ctx interface{}) {
-	c.ctx = ctx
+// UserData 取得關聯資源 , 可藉由 SetUserData() 設定
+func (c *Conn) UserData() interface{} {
+	return c.userData
 }
 
-// Context 取得關聯資源 , 可藉由 SetContext() 設定
-func (c *Conn) Context() interface{} {
+// Context 返回連線的 context , 衍生自 Serve 的 ctx
+// Serve 的 ctx 結束 , Shutdown 逾時或連線處理完畢時會被取消
+func (c *Conn) Context() context.Context {
 	return c.ctx
 }
 
 // Server ...
 func (c *Conn) Server() *Server { return c.server }
 
-// Serve ...
-func (s *Server) Serve(event Event) error {
-	var err error
-	s.shutdown = false
-	s.listener, err = net.Listen("tcp", s.BindAddress)
+// logger 返回帶有 Server 欄位及 remote_addr 的 log entry
+func (c *Conn) logger() *log.Entry {
+	return c.server.logger().WithField("remote_addr", c.RemoteAddr().String())
+}
 
-	if err != nil {
+// logger 返回帶有 bind 及 instance (有設定 Name 時) 欄位的 log entry
+func (s *Server) logger() *log.Entry {
+	fields := log.Fields{"bind": s.BindAddress}
+	if s.Name != "" {
+		fields["instance"] = s.Name
+	}
+	return log.WithFields(fields)
+}
+
+// source 返回事件的 Source , 與 log 的 instance 欄位相同 , 沒有設定 Name 時為 BindAddress
+func (s *Server) source() string {
+	if s.Name != "" {
+		return s.Name
+	}
+	return s.BindAddress
+}
+
+// Addr 返回 listener 實際的位址 , 尚未 listen 時返回 nil
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// Serve 開始 listen 並接受連線 , 直到 Shutdown 或 ctx 結束
+// ctx 結束時會停止接受連線並取消所有連線的 context , 不等待處理中的連線
+func (s *Server) Serve(ctx context.Context, event Event) error {
+	var err error
+	if s.allowedNets, err = parseAllowedClients(s.AllowedClients); err != nil {
 		return err
 	}
-	log.Debugf("Server %s starting listener", s.BindAddress)
+	if s.Listener != nil {
+		s.listener = s.Listener
+		s.ownSocket = s.OwnListener
+	} else {
+		s.listener, err = s.listen()
+		if err != nil {
+			return err
+		}
+		s.ownSocket = true
+	}
+	s.rawListener = s.listener
+	s.logger().Debug("Server starting listener")
 
 	s.listener = netutil.LimitListener(s.listener, s.MaxConnections)
+
+	if s.TLS != nil {
+		reloader, err := newCertReloader(*s.TLS)
+		if err != nil {
+			s.listener.Close()
+			return err
+		}
+		s.listener = tls.NewListener(s.listener, reloader.tlsConfig())
+	}
+
+	// 連線的 context 衍生自 baseCtx , Shutdown 等待期間不會被取消
+	baseCtx, cancel := context.WithCancel(ctx)
+	s.mutex.Lock()
+	s.shutdown = false
+	s.active = make(map[*Conn]struct{})
+	s.clients = make(map[string]int)
+	s.cancel = cancel
+	s.mutex.Unlock()
+
 	var nextAction Action
 	nextAction = None
 
@@ -62,42 +238,68 @@ func (s *Server) Serve(event Event) error {
 	}
 
 	if &nextAction == nil || nextAction == None {
-		return s.loopAccept(event)
+		// ctx 結束時停止接受連線 , 連線的 context 衍生自 ctx , 會一起被取消
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.stopAccept()
+			case <-stop:
+			}
+		}()
+		if err = s.loopAccept(baseCtx, event); err != nil {
+			cancel()
+		}
+		return err
 	}
 
+	cancel()
 	return nil
 }
 
 // loopAccept 開始接受外部連線
-func (s *Server) loopAccept(event Event) error {
+func (s *Server) loopAccept(ctx context.Context, event Event) error {
 
-	log.Infof("Server %s starting accept", s.BindAddress)
-	s.shutdownChan = make(chan bool, 1)
+	s.logger().Info("Server starting accept")
 
 	for {
-
-		select {
-		default:
-		case <-s.shutdownChan:
-			s.triggerOnShutdown(event)
-			return nil
-		}
-
 		netconn, err := s.listener.Accept()
 
 		if err == nil {
-			conn := &Conn{netconn, nil, s}
+			if !s.isAllowed(netconn) {
+				s.reject(netconn)
+				continue
+			}
+			conn := &Conn{Conn: netconn, server: s, client: clientIP(netconn)}
+			conn.ctx, conn.cancel = context.WithCancel(ctx)
+			conn.touch()
+			if s.ReadHeaderTimeout > 0 {
+				conn.headerDeadline = time.Now().Add(s.ReadHeaderTimeout)
+			}
 			if log.IsLevelEnabled(log.DebugLevel) {
-				log.Debugf("Accept %s to %s", conn.RemoteAddr().String(), conn.LocalAddr().String())
+				conn.logger().Debug("Accept connection")
+			}
+			if ok, throttled := s.track(conn); !ok {
+				conn.cancel()
+				if throttled {
+					s.throttle(conn)
+				} else {
+					// 已經 Shutdown , 不再處理新的連線
+					conn.Close()
+				}
+				continue
 			}
 			go func(c *Conn) {
+				defer s.untrack(c)
 
 				nextAction := s.triggerOnConnect(event, c)
 				switch nextAction {
 				case Close:
 					s.triggerOnDisconnect(event, c)
 				case Shutdown:
-					s.Shutdown()
+					// Shutdown 會等待這個連線結束 , 所以不能在這裡等待
+					go s.Shutdown(context.Background())
 
 				}
 
@@ -108,8 +310,12 @@ func (s *Server) loopAccept(event Event) error {
 				netconn.Close()
 			}
 
-			if s.shutdown == true {
-				err = nil
+			s.mutex.Lock()
+			shutdown := s.shutdown
+			s.mutex.Unlock()
+			if shutdown {
+				s.triggerOnShutdown(event)
+				return nil
 			}
 
 			return err
@@ -119,9 +325,61 @@ func (s *Server) loopAccept(event Event) error {
 
 }
 
+// track 記錄處理中的連線 , 已經 Shutdown 或來源 IP 超過 MaxConnectionsPerClient 時 ok 為 false
+func (s *Server) track(c *Conn) (ok bool, throttled bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.shutdown {
+		return false, false
+	}
+	if !s.addClient(c.client) {
+		return false, true
+	}
+	s.active[c] = struct{}{}
+	s.conns.Add(1)
+	return true, false
+}
+
+// untrack 連線處理完畢 , 取消連線的 context
+func (s *Server) untrack(c *Conn) {
+	c.cancel()
+	s.mutex.Lock()
+	delete(s.active, c)
+	s.removeClient(c.client)
+	s.mutex.Unlock()
+	s.conns.Done()
+}
+
+// addClient 增加來源 IP 的連線數量 , 超過 MaxConnectionsPerClient 時返回 false , 必須持有 mutex
+func (s *Server) addClient(client string) bool {
+	if s.MaxConnectionsPerClient > 0 && client != "" {
+		if s.clients[client] >= s.MaxConnectionsPerClient {
+			return false
+		}
+		s.clients[client]++
+	}
+	return true
+}
+
+// removeClient 減少來源 IP 的連線數量 , 必須持有 mutex
+func (s *Server) removeClient(client string) {
+	if s.MaxConnectionsPerClient > 0 && client != "" {
+		if s.clients[client]--; s.clients[client] <= 0 {
+			delete(s.clients, client)
+		}
+	}
+}
+
+// ActiveConnections 返回處理中的連線數量
+func (s *Server) ActiveConnections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.active)
+}
+
 func (s *Server) triggerOnConnect(event Event, c *Conn) Action {
 	if log.IsLevelEnabled(log.DebugLevel) {
-		log.Debugf("Client connect %s to %s", c.RemoteAddr().String(), c.LocalAddr().String())
+		c.logger().Debug("Client connect")
 	}
 	nextAction := Close
 	if event.OnConnect != nil {
@@ -135,7 +393,7 @@ func (s *Server) triggerOnConnect(event Event, c *Conn) Action {
 
 func (s *Server) triggerOnDisconnect(event Event, c *Conn) Action {
 	if log.IsLevelEnabled(log.DebugLevel) {
-		log.Debugf("Client disconnect %s to %s", c.RemoteAddr().String(), c.LocalAddr().String())
+		c.logger().Debug("Client disconnect")
 	}
 	nextAction := None
 	c.Close() // 關閉連線
@@ -154,12 +412,56 @@ func (s *Server) triggerOnShutdown(event Event) {
 	}
 }
 
-// Shutdown 停止服務
-func (s *Server) Shutdown() {
+// stopAccept 停止接受連線並移除 unix socket , 可以重複呼叫
+func (s *Server) stopAccept() {
+	s.mutex.Lock()
+	if s.shutdown || s.listener == nil {
+		s.mutex.Unlock()
+		return
+	}
 	s.shutdown = true
-	close(s.shutdownChan)
+	s.mutex.Unlock()
 	s.listener.Close()
-	log.Debugf("Server %s shutdown", s.BindAddress)
+	s.removeSocket()
+	s.logger().Debug("Server shutdown")
+}
+
+// Shutdown 停止接受連線 , 並等待處理中的連線結束 , 可以重複呼叫
+// ctx 先結束時 , 取消所有連線的 context 並強制關閉連線 , 返回 ctx.Err()
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopAccept()
+
+	drained := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		s.mutex.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mutex.Unlock()
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mutex.Lock()
+	if s.cancel != nil {
+		s.cancel()
+	}
+	for c := range s.active {
+		c.Close()
+	}
+	s.mutex.Unlock()
+	s.logger().Warn("Server shutdown timeout , active connections are closed")
+	return ctx.Err()
+}
+
+// Wait 等待所有處理中的連線結束 , 通常在 Shutdown 之後呼叫
+func (s *Server) Wait() {
+	s.conns.Wait()
 }
 
 // Action 定義 Server 接下來的動作
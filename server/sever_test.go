@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrain(t *testing.T) {
+	ready := make(chan struct{})
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			select {
+			case <-release:
+				c.Write([]byte("ok"))
+			case <-c.Context().Done():
+				close(cancelled)
+			}
+			return Close
+		},
+	}
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(context.Background(), events) }()
+	<-ready
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitActive(t, s, 1)
+
+	// 處理中的連線結束前 , Shutdown 逾時並取消連線的 context
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected DeadlineExceeded , got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection context is not cancelled")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve should return nil after Shutdown , got %v", err)
+	}
+	waitActive(t, s, 0)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("second Shutdown : %v", err)
+	}
+}
+
+func TestServeContextCancel(t *testing.T) {
+	ready := make(chan struct{})
+	release := make(chan struct{})
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			<-release
+			c.Write([]byte("ok"))
+			return Close
+		},
+	}
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, events) }()
+	<-ready
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitActive(t, s, 1)
+
+	cancel()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve should return nil after ctx is cancelled , got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve does not return")
+	}
+	if _, err := net.Dial("tcp", s.Addr().String()); err == nil {
+		t.Error("listener should be closed")
+	}
+
+	// 處理中的連線仍可以完成 , Shutdown 等待它結束
+	close(release)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+	if n := s.ActiveConnections(); n != 0 {
+		t.Errorf("expected 0 active connections , got %d", n)
+	}
+}
+
+// waitActive 等待 ActiveConnections 等於 n
+func waitActive(t *testing.T, s *Server, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveConnections() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d active connections , got %d", n, s.ActiveConnections())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// startTimeoutServer 啟動一個 Server , OnConnect 的讀取結果送到 results
+func startTimeoutServer(t *testing.T, s *Server, onConnect func(c *Conn) error) chan error {
+	ready := make(chan struct{})
+	results := make(chan error, 1)
+	events := Event{
+		OnStartup: func(*Server) Action {
+			close(ready)
+			return None
+		},
+		OnConnect: func(c *Conn) Action {
+			results <- onConnect(c)
+			return Close
+		},
+	}
+	go s.Serve(context.Background(), events)
+	<-ready
+	return results
+}
+
+func TestReadHeaderTimeout(t *testing.T) {
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, ReadHeaderTimeout: 50 * time.Millisecond, IdleTimeout: time.Minute}
+	results := startTimeoutServer(t, s, func(c *Conn) error {
+		b := make([]byte, 4)
+		_, err := c.Read(b)
+		return err
+	})
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	select {
+	case err := <-results:
+		if !isTimeout(err) {
+			t.Errorf("expected timeout , got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadHeaderTimeout does not work")
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	s := &Server{BindAddress: "127.0.0.1:0", MaxConnections: 4, ReadHeaderTimeout: 50 * time.Millisecond, IdleTimeout: 100 * time.Millisecond}
+	results := startTimeoutServer(t, s, func(c *Conn) error {
+		b := make([]byte, 4)
+		if _, err := c.Read(b); err != nil {
+			return err
+		}
+		c.HeaderRead()
+		// 持續寫出資料時 , 即使沒有讀到資料也不算閒置
+		go func() {
+			for i := 0; i < 5; i++ {
+				time.Sleep(50 * time.Millisecond)
+				c.Write([]byte("x"))
+			}
+		}()
+		start := time.Now()
+		_, err := c.Read(b)
+		if time.Since(start) < 300*time.Millisecond {
+			return errors.New("idle timeout before writes stopped")
+		}
+		return err
+	})
+	defer s.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("head"))
+	select {
+	case err := <-results:
+		if !isTimeout(err) {
+			t.Errorf("expected timeout , got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("IdleTimeout does not work")
+	}
+}
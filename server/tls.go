@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSOptions 定義 listener 的 TLS 設定
+type TLSOptions struct {
+	// CertFile 及 KeyFile 為 PEM 格式的憑證及私鑰
+	CertFile string
+	KeyFile  string
+	// ClientCAFile 設定後 , client 必須提供由此 CA 簽發的憑證 (mutual TLS)
+	ClientCAFile string
+	// MinVersion 可以是 1.0 , 1.1 , 1.2 , 1.3 , 預設 1.2
+	MinVersion string
+}
+
+// tlsReloadInterval 檢查憑證檔案是否更新的間隔
+var tlsReloadInterval = time.Second
+
+// ParseTLSVersion 將 1.0 ~ 1.3 轉為 tls.VersionTLSxx , 空字串返回 tls.VersionTLS12
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "":
+		return tls.VersionTLS12, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %s", version)
+}
+
+// certReloader 在憑證檔案更新後自動重新載入 , 不需要重新啟動
+type certReloader struct {
+	options    TLSOptions
+	minVersion uint16
+
+	mutex    sync.Mutex
+	config   *tls.Config
+	modTimes []time.Time // CertFile , KeyFile , ClientCAFile 的修改時間
+	checked  time.Time
+}
+
+func newCertReloader(options TLSOptions) (*certReloader, error) {
+	if options.CertFile == "" || options.KeyFile == "" {
+		return nil, errors.New("TLS CertFile and KeyFile are required")
+	}
+	minVersion, err := ParseTLSVersion(options.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	r := &certReloader{options: options, minVersion: minVersion}
+	if err = r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files 返回需要監控的檔案
+func (r *certReloader) files() []string {
+	files := []string{r.options.CertFile, r.options.KeyFile}
+	if r.options.ClientCAFile != "" {
+		files = append(files, r.options.ClientCAFile)
+	}
+	return files
+}
+
+// load 讀取憑證並建立新的 tls.Config
+func (r *certReloader) load() error {
+	modTimes := make([]time.Time, 0, 3)
+	for _, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.options.CertFile, r.options.KeyFile)
+	if err != nil {
+		return err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.minVersion,
+	}
+
+	if r.options.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.options.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s does not contain any certificate", r.options.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+// modified 檢查憑證檔案是否有變更
+func (r *certReloader) modified() bool {
+	for i, file := range r.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			// 檔案可能正在替換中 , 下次再檢查
+			return false
+		}
+		if !fi.ModTime().Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// getConfigForClient 每次 handshake 時呼叫 , 必要時重新載入憑證
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if time.Since(r.checked) >= tlsReloadInterval {
+		r.checked = time.Now()
+		if r.modified() {
+			if err := r.load(); err != nil {
+				// 載入失敗時繼續使用原本的憑證
+				log.WithField("cert", r.options.CertFile).WithError(err).Error("TLS reload error")
+			} else {
+				log.WithField("cert", r.options.CertFile).Info("TLS certificate reloaded")
+			}
+		}
+	}
+	return r.config, nil
+}
+
+// tlsConfig 返回給 tls.NewListener 使用的設定
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{GetConfigForClient: r.getConfigForClient}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert 產生由 parent 簽發的憑證 , parent 為 nil 時產生自簽的 CA
+func testCert(t *testing.T, cn string, serial int64, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeCert 將憑證及私鑰以 PEM 格式寫入檔案
+func writeCert(t *testing.T, cert tls.Certificate, certFile string, keyFile string) {
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tlsReply 以 TLS 連線並返回 server 送來的資料
+func tlsReply(addr string, config *tls.Config) (string, error) {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 2)
+	n, err := conn.Read(b)
+	return string(b[:n]), err
+}
+
+func TestTLSListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wphpfpm-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := testCert(t, "test ca", 1, nil)
+	serverCert := testCert(t, "server", 2, &ca)
+	clientCert := testCert(t, "client", 3, &ca)
+
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeCert(t, serverCert, certFile, keyFile)
+	writeCert(t, ca, caFile, "")
+
+	s := &Server{
+		BindAddress:    "127.0.0.1:0",
+		MaxConnections: 4,
+		TLS:            &TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: "1.2"},
+	}
+	startTestServer(t, s)
+	defer s.Shutdown(context.Background())
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	addr := s.Addr().String()
+
+	if reply, err := tlsReply(addr, &tls.Config{RootCAs: roots}); err == nil && reply == "ok" {
+		t.Error("client without certificate should be rejected")
+	}
+
+	config := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}
+	reply, err := tlsReply(addr, config)
+	if err != nil || reply != "ok" {
+		t.Fatalf("mutual TLS failed : %q , %v", reply, err)
+	}
+
+	// 更新憑證檔案後 , 不需要重新啟動就會使用新的憑證
+	tlsReloadInterval = 0
+	defer func() { tlsReloadInterval = time.Second }()
+	renewed := testCert(t, "server", 4, &ca)
+	writeCert(t, renewed, certFile, keyFile)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	var serial *big.Int
+	config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+		serial = chains[0][0].SerialNumber
+		return nil
+	}
+	if _, err := tlsReply(addr, config); err != nil {
+		t.Fatal(err)
+	}
+	if serial == nil || serial.Int64() != 4 {
+		t.Errorf("expected renewed certificate serial 4 , got %v", serial)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// interactiveSession 非 windows 平台一律以命令列模式執行 , 服務由 systemd 等工具管理
+func interactiveSession() bool {
+	return true
+}
+
+// checkServiceSupported install , uninstall , start 及 stop 只有 windows 支援
+func checkServiceSupported() {
+	fmt.Println("Windows service is not supported on this platform , please use run.")
+	os.Exit(1)
+}
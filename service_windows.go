@@ -0,0 +1,14 @@
+package main
+
+import (
+	"github.com/chai2010/winsvc"
+)
+
+// interactiveSession 是否在命令列模式執行 , 否則是由 Windows Service 啟動
+func interactiveSession() bool {
+	return winsvc.IsAnInteractiveSession()
+}
+
+// checkServiceSupported windows 支援 install , uninstall , start 及 stop
+func checkServiceSupported() {
+}
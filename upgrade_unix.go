@@ -0,0 +1,171 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// envReadyFd 新的行程就緒後 , 寫入此環境變數指定的 fd 通知舊的行程
+	envReadyFd = "WPHPFPM_READY_FD"
+	// upgradeTimeout 等待新的行程就緒的時間
+	upgradeTimeout = 30 * time.Second
+)
+
+// readyFile 升級時由舊的行程傳進來的 pipe , 不是升級啟動時為 nil
+var readyFile *os.File
+
+// sendUpgrade 對執行中的 wphpfpm 送出 SIGUSR2 , 同 nginx 的升級方式
+func sendUpgrade(pid int) error {
+	return syscall.Kill(pid, syscall.SIGUSR2)
+}
+
+// prepareUpgradeChild 如果是升級啟動的新行程 , 取得通知用的 pipe
+// 必須在啟動 php-cgi 之前呼叫 , 避免 fd 被 php-cgi 繼承
+func prepareUpgradeChild() {
+	s := os.Getenv(envReadyFd)
+	os.Unsetenv(envReadyFd)
+	if s == "" {
+		return
+	}
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return
+	}
+	syscall.CloseOnExec(fd)
+	readyFile = os.NewFile(uintptr(fd), "ready")
+}
+
+// isUpgradeChild 是否為升級時啟動的新行程 , 必須在 notifyReady 之前呼叫
+func isUpgradeChild() bool {
+	return readyFile != nil
+}
+
+// notifyReady 通知舊的行程 , 新的行程已經就緒
+func notifyReady() {
+	if readyFile == nil {
+		return
+	}
+	if _, err := readyFile.Write([]byte("ready\n")); err != nil {
+		log.Errorf("Can not notify old process , because %s", err.Error())
+	}
+	readyFile.Close()
+	readyFile = nil
+}
+
+// watchUpgrade 收到 SIGUSR2 時啟動新的執行檔 , 新的行程就緒後停止接受連線 ,
+// 等待處理中的連線結束後退出
+func watchUpgrade() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	go func() {
+		for range c {
+			log.Info("Service got upgrade signal")
+			if err := upgrade(); err != nil {
+				log.Errorf("Upgrade failed , because %s", err.Error())
+				continue
+			}
+			signal.Stop(c)
+			stopReason.Store("upgraded")
+			for _, s := range servers {
+				s.HandOff()
+			}
+			stopService()
+			return
+		}
+	}()
+}
+
+// upgrade 執行新的執行檔並將所有 listener 傳過去 , 直到新的行程就緒
+func upgrade() error {
+	files := make([]*os.File, 0, len(servers)+len(httpFronts)+1)
+	names := make([]string, 0, len(servers)+len(httpFronts))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, s := range servers {
+		f, err := s.ListenerFile()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, managers[s.Tag.(int)].Instance().Name)
+	}
+
+	for _, h := range httpFronts {
+		l, ok := h.listener.(*net.TCPListener)
+		if !ok {
+			return errors.New("HTTP listener " + h.listener.Addr().String() + " can not be handed off")
+		}
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		// 新的行程以位址比對 HTTPListen
+		names = append(names, "")
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	files = append(files, w)
+
+	// 新的行程以 systemd socket activation 相同的方式取得 listener
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(names)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		envReadyFd+"="+strconv.Itoa(3+len(names)),
+	)
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	// 關閉自己這端的 w , 新的行程異常結束時才讀得到 EOF
+	w.Close()
+	files = files[:len(files)-1]
+	go cmd.Wait()
+
+	log.Infof("Waiting new process (pid %d) ready", cmd.Process.Pid)
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 16)
+		if n, _ := r.Read(b); n > 0 {
+			ready <- nil
+			return
+		}
+		ready <- errors.New("new process exited before ready")
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeTimeout):
+		err = errors.New("new process is not ready in " + upgradeTimeout.String())
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+	log.Infof("New process (pid %d) is ready , stop accepting connections", cmd.Process.Pid)
+	return nil
+}
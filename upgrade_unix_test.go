@@ -0,0 +1,123 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"wphpfpm/server"
+)
+
+// envUpgradeChild 測試時 upgrade 以測試執行檔本身作為新的行程 , 這個環境變數決定它的行為
+// ready : 取得傳入的 listener , 通知就緒後以它回應一個連線 ; exit : 就緒前直接結束
+const envUpgradeChild = "WPHPFPM_TEST_UPGRADE_CHILD"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(envUpgradeChild); mode != "" {
+		upgradeChild(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// upgradeChild 模擬升級時啟動的新行程
+func upgradeChild(mode string) {
+	if mode != "ready" {
+		os.Exit(1)
+	}
+	prepareUpgradeChild()
+	inherited, err := server.InheritedListeners()
+	if err != nil || len(inherited) != 1 || !isUpgradeChild() {
+		os.Exit(2)
+	}
+	notifyReady()
+	conn, err := inherited[0].Listener.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	conn.Write([]byte("new process"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestNotifyReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	// prepareUpgradeChild 接手 fd , 由 notifyReady 關閉
+	fd, err := syscall.Dup(int(w.Fd()))
+	w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv(envReadyFd, strconv.Itoa(fd))
+	prepareUpgradeChild()
+	if os.Getenv(envReadyFd) != "" {
+		t.Errorf("%s is not removed", envReadyFd)
+	}
+	if !isUpgradeChild() {
+		t.Fatal("isUpgradeChild should be true")
+	}
+	notifyReady()
+	if isUpgradeChild() {
+		t.Error("isUpgradeChild should be false after notifyReady")
+	}
+	// notifyReady 關閉 fd 後讀到 EOF
+	b, err := ioutil.ReadAll(r)
+	if err != nil || string(b) != "ready\n" {
+		t.Errorf("ready pipe = %q , %v", b, err)
+	}
+}
+
+func TestUpgradeHandOff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer func(fronts []httpFront) { httpFronts = fronts }(httpFronts)
+	httpFronts = []httpFront{{listener: l}}
+
+	os.Setenv(envUpgradeChild, "ready")
+	defer os.Unsetenv(envUpgradeChild)
+	if err := upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	// 舊的行程停止接受連線 , 之後的連線由新的行程處理
+	l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := ioutil.ReadAll(conn)
+	if err != nil || string(b) != "new process" {
+		t.Errorf("response = %q , %v", b, err)
+	}
+}
+
+func TestUpgradeExitBeforeReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	defer func(fronts []httpFront) { httpFronts = fronts }(httpFronts)
+	httpFronts = []httpFront{{listener: l}}
+
+	os.Setenv(envUpgradeChild, "exit")
+	defer os.Unsetenv(envUpgradeChild)
+	if err := upgrade(); err == nil || !strings.Contains(err.Error(), "exited before ready") {
+		t.Errorf("expected exited before ready , got %v", err)
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+)
+
+// sendUpgrade windows 無法將 listener 交給新的行程 , 不支援升級
+func sendUpgrade(pid int) error {
+	return errors.New("upgrade is not supported on windows")
+}
+
+// prepareUpgradeChild windows 不支援升級
+func prepareUpgradeChild() {
+}
+
+// watchUpgrade windows 不支援升級
+func watchUpgrade() {
+}
+
+// isUpgradeChild windows 不支援升級
+func isUpgradeChild() bool {
+	return false
+}
+
+// notifyReady windows 不支援升級
+func notifyReady() {
+}